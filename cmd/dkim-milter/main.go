@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,11 +21,11 @@ import (
 	"path"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/emersion/go-milter"
 	"github.com/sschekotikhin/go-msgauth/authres"
 	"github.com/sschekotikhin/go-msgauth/dkim"
-	"github.com/sschekotikhin/openssl"
 )
 
 var (
@@ -29,10 +34,16 @@ var (
 	listenURI      string
 	privateKeyPath string
 	selector       string
+	keyringPath    string
+	keyCacheSize   int
+	verifyTimeout  time.Duration
+	minRSAKeySize  int
 	verbose        bool
 )
 
-var privateKey openssl.PrivateKey
+var keyring dkim.Keyring
+
+var keyCache *dkim.KeyCache
 
 var signHeaderKeys = []string{
 	"From",
@@ -56,7 +67,14 @@ var signHeaderKeys = []string{
 	"List-Archive",
 }
 
-const maxVerifications = 5
+const (
+	maxVerifications   = 5
+	maxHeaderBytes     = 1024 * 1024
+	maxHeaderFields    = 1000
+	maxSignatureLength = 16 * 1024
+	maxHeaderKeys      = 100
+	maxDNSQueries      = 5
+)
 
 func init() {
 	flag.Var(&signDomains, "d", "Domain(s) whose mail should be signed (matched using path.Match)")
@@ -64,6 +82,10 @@ func init() {
 	flag.StringVar(&listenURI, "l", "unix:///tmp/dkim-milter.sock", "Listen URI")
 	flag.StringVar(&privateKeyPath, "k", "", "Private key (PEM-formatted)")
 	flag.StringVar(&selector, "s", "", "Selector")
+	flag.StringVar(&keyringPath, "K", "", "Keyring file, listing keys with their selector and validity period")
+	flag.IntVar(&keyCacheSize, "c", 1024, "Maximum number of cached public keys (0 disables the cache)")
+	flag.DurationVar(&verifyTimeout, "t", 30*time.Second, "Maximum duration of public key lookups for a message")
+	flag.IntVar(&minRSAKeySize, "r", 1024, "Minimum size in bits of RSA keys used by verified signatures")
 	flag.BoolVar(&verbose, "v", false, "Enable verbose logging")
 }
 
@@ -84,14 +106,13 @@ type session struct {
 	authResDelete []int
 	headerBuf     bytes.Buffer
 
-	signDomain     string
-	signHeaderKeys []string
+	signDomain string
 
-	done   <-chan error
-	pw     *io.PipeWriter
-	verifs []*dkim.Verification // only valid after done is closed
-	signer *dkim.Signer
-	mw     io.Writer
+	cancel   context.CancelFunc
+	verifier *dkim.Verifier
+	verifs   []*dkim.Verification // only valid after the verifier is closed
+	signer   *dkim.Signer
+	mw       io.Writer
 }
 
 func parseAddressDomain(s string) (string, error) {
@@ -126,12 +147,6 @@ func (s *session) Header(name string, value string, m *milter.Modifier) (milter.
 		}
 	}
 
-	for _, k := range signHeaderKeys {
-		if strings.EqualFold(name, k) {
-			s.signHeaderKeys = append(s.signHeaderKeys, name)
-		}
-	}
-
 	field := name + ": " + value + "\r\n"
 	_, err := s.headerBuf.WriteString(field)
 	return milter.RespContinue, err
@@ -183,46 +198,60 @@ func (s *session) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Re
 
 	// Sign if necessary
 	if s.signDomain != "" {
-		opts := dkim.SignOptions{
-			Domain:       s.signDomain,
-			Selector:     selector,
-			Signer:       privateKey,
-			HeaderKeys:   s.signHeaderKeys,
-			QueryMethods: []dkim.QueryMethod{dkim.QueryMethodDNSTXT},
-		}
-
-		var err error
-		s.signer, err = dkim.NewSigner(&opts)
+		opts, err := keyring.SignOptions(s.signDomain, &dkim.SignOptions{
+			HeaderKeys:         signHeaderKeys,
+			OversignHeaderKeys: signHeaderKeys,
+			QueryMethods:       []dkim.QueryMethod{dkim.QueryMethodDNSTXT},
+		})
 		if err != nil {
+			// A gap in the keyring must not prevent mail from flowing
+			log.Printf("Warning: not signing message from %v: %v", s.signDomain, err)
+		} else if s.signer, err = dkim.NewSigner(opts); err != nil {
 			return nil, err
 		}
 	}
 
-	// Verify existing signatures
-	done := make(chan error, 1)
-	pr, pw := io.Pipe()
-
-	s.done = done
-	s.pw = pw
-
-	// TODO: limit max. number of signatures
-	go func() {
-		options := dkim.VerifyOptions{MaxVerifications: maxVerifications}
-
-		var err error
-		s.verifs, err = dkim.VerifyWithOptions(pr, &options)
-		io.Copy(ioutil.Discard, pr)
-		pr.Close()
-		done <- err
-		close(done)
-	}()
+	// Verify existing signatures. The session may have been used for a
+	// previous message which didn't complete: release its verifier first.
+	s.closeVerifier()
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	s.cancel = cancel
+	s.verifier = dkim.NewVerifierWithContext(ctx, &dkim.VerifyOptions{
+		MaxVerifications:   maxVerifications,
+		MaxHeaderBytes:     maxHeaderBytes,
+		MaxHeaderFields:    maxHeaderFields,
+		MaxSignatureLength: maxSignatureLength,
+		MaxHeaderKeys:      maxHeaderKeys,
+		MaxDNSQueries:      maxDNSQueries,
+		KeyCache:           keyCache,
+		Policy: &dkim.Policy{
+			MinKeySizes: map[string]int{dkim.KeyAlgoRSA: minRSAKeySize},
+		},
+	})
 
 	// Process header
 	return s.BodyChunk(s.headerBuf.Bytes(), m)
 }
 
+// closeVerifier aborts the verification of the current message, if any, and
+// waits for its public key lookups to complete.
+//
+// Sessions dropped by the milter library, for instance when a message is
+// aborted, can't be notified: their lookups stop when verifyTimeout expires.
+func (s *session) closeVerifier() {
+	if s.verifier == nil {
+		return
+	}
+	s.verifier.Abort()
+	s.cancel()
+	s.verifier = nil
+	s.cancel = nil
+}
+
 func (s *session) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
-	if _, err := s.pw.Write(chunk); err != nil {
+	// Messages exceeding the verification limits are still signed, the error
+	// is reported when the verifier is closed
+	if _, err := s.verifier.Write(chunk); err != nil && !errors.Is(err, dkim.ErrLimitExceeded) {
 		return nil, err
 	}
 	if s.signer != nil {
@@ -234,21 +263,26 @@ func (s *session) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response,
 }
 
 func (s *session) Body(m *milter.Modifier) (milter.Response, error) {
-	if err := s.pw.Close(); err != nil {
-		return nil, err
-	}
-
 	for _, index := range s.authResDelete {
 		if err := m.ChangeHeader(index, "Authentication-Results", ""); err != nil {
 			return nil, err
 		}
 	}
 
-	if err := <-s.done; err == dkim.ErrTooManySignatures {
+	err := s.verifier.Close()
+	s.verifs = s.verifier.Verifications()
+	s.closeVerifier()
+	limitExceeded := false
+	if err == dkim.ErrTooManySignatures {
 		if verbose {
 			log.Printf("Too many signatures in message: %v", err)
 		}
 		// Ignore the error
+	} else if errors.Is(err, dkim.ErrLimitExceeded) {
+		if verbose {
+			log.Printf("Message exceeds verification limits: %v", err)
+		}
+		limitExceeded = true
 	} else if err != nil {
 		if verbose {
 			log.Printf("DKIM verification failed: %v", err)
@@ -278,7 +312,14 @@ func (s *session) Body(m *milter.Modifier) (milter.Response, error) {
 
 	results := make([]authres.Result, 0, len(s.verifs))
 
-	if len(s.verifs) == 0 && s.signer == nil {
+	if limitExceeded {
+		// The message wasn't checked, which says nothing about its
+		// signatures (RFC 8601 section 2.7.1)
+		results = append(results, &authres.DKIMResult{
+			Value:  authres.ResultPolicy,
+			Reason: string(dkim.ErrLimitExceeded),
+		})
+	} else if len(s.verifs) == 0 && s.signer == nil {
 		results = append(results, &authres.DKIMResult{
 			Value: authres.ResultNone,
 		})
@@ -300,18 +341,38 @@ func (s *session) Body(m *milter.Modifier) (milter.Response, error) {
 			val = authres.ResultPermError
 		} else if dkim.IsTempFail(verif.Err) {
 			val = authres.ResultTempError
+		} else if dkim.IsPolicyFail(verif.Err) {
+			val = authres.ResultPolicy
 		} else {
 			val = authres.ResultFail
 		}
 
+		var reason string
+		var dkimErr *dkim.Error
+		if errors.As(verif.Err, &dkimErr) {
+			reason = string(dkimErr.Reason)
+		}
+
+		// Failures of signatures made with a key in testing mode must not be
+		// treated differently from unsigned messages
+		if verif.Err != nil && verif.Testing {
+			val = authres.ResultNeutral
+			if reason != "" {
+				reason = "key in testing mode: " + reason
+			} else {
+				reason = "key in testing mode"
+			}
+		}
+
 		results = append(results, &authres.DKIMResult{
 			Value:      val,
+			Reason:     reason,
 			Domain:     verif.Domain,
 			Identifier: verif.Identifier,
 		})
 	}
 
-	if len(s.verifs) > 0 || s.signer == nil {
+	if len(s.verifs) > 0 || s.signer == nil || limitExceeded {
 		v := authres.Format(identity, results)
 		if err := m.InsertHeader(0, "Authentication-Results", v); err != nil {
 			return nil, err
@@ -321,8 +382,8 @@ func (s *session) Body(m *milter.Modifier) (milter.Response, error) {
 	return milter.RespAccept, nil
 }
 
-func loadPrivateKey(path string) (openssl.PrivateKey, error) {
-	b, err := ioutil.ReadFile(privateKeyPath)
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -334,14 +395,77 @@ func loadPrivateKey(path string) (openssl.PrivateKey, error) {
 
 	switch strings.ToUpper(block.Type) {
 	case "PRIVATE KEY":
-		return openssl.LoadPrivateKeyFromPEM(block.Bytes)
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type: %T", k)
+		}
+		return signer, nil
 	case "RSA PRIVATE KEY":
-		return openssl.LoadPrivateKeyFromPEM(block.Bytes)
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
 	default:
 		return nil, fmt.Errorf("unknown private key type: '%v'", block.Type)
 	}
 }
 
+// loadKeyring reads a keyring file. Each line contains a domain (or "*"), a
+// selector, a private key path and optionally activation and retirement
+// timestamps (RFC 3339, or "-" for none). Empty lines and lines starting with
+// "#" are ignored.
+func loadKeyring(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 5 {
+			return fmt.Errorf("line %v: expected 3 to 5 fields, got %v", lineno, len(fields))
+		}
+
+		k := &dkim.KeyringKey{
+			Domain:   strings.ToLower(fields[0]),
+			Selector: fields[1],
+		}
+		if k.Signer, err = loadPrivateKey(fields[2]); err != nil {
+			return fmt.Errorf("line %v: failed to load private key from '%v': %v", lineno, fields[2], err)
+		}
+		if len(fields) > 3 {
+			if k.NotBefore, err = parseKeyringTime(fields[3]); err != nil {
+				return fmt.Errorf("line %v: %v", lineno, err)
+			}
+		}
+		if len(fields) > 4 {
+			if k.NotAfter, err = parseKeyringTime(fields[4]); err != nil {
+				return fmt.Errorf("line %v: %v", lineno, err)
+			}
+		}
+
+		if err := keyring.Add(k); err != nil {
+			return fmt.Errorf("line %v: %v", lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func parseKeyringTime(s string) (time.Time, error) {
+	if s == "-" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
 func main() {
 	flag.Parse()
 
@@ -353,8 +477,12 @@ func main() {
 		}
 	}
 
-	if (len(signDomains) > 0 || privateKeyPath != "" || selector != "") && !(len(signDomains) > 0 && privateKeyPath != "" && selector != "") {
-		log.Fatal("Domain(s) (-d) and private key (-k) must be both specified")
+	if privateKeyPath != "" && keyringPath != "" {
+		log.Fatal("Private key (-k) and keyring (-K) are mutually exclusive")
+	}
+	hasKey := (privateKeyPath != "" && selector != "") || keyringPath != ""
+	if (len(signDomains) > 0 || privateKeyPath != "" || selector != "" || keyringPath != "") && !(len(signDomains) > 0 && hasKey) {
+		log.Fatal("Domain(s) (-d) and private key (-k and -s, or -K) must be both specified")
 	}
 
 	for i, pattern := range signDomains {
@@ -365,11 +493,27 @@ func main() {
 	}
 
 	if privateKeyPath != "" {
-		var err error
-		privateKey, err = loadPrivateKey(privateKeyPath)
+		privateKey, err := loadPrivateKey(privateKeyPath)
 		if err != nil {
 			log.Fatalf("Failed to load private key from '%v': %v", privateKeyPath, err)
 		}
+		err = keyring.Add(&dkim.KeyringKey{
+			Domain:   "*",
+			Selector: selector,
+			Signer:   privateKey,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if keyringPath != "" {
+		if err := loadKeyring(keyringPath); err != nil {
+			log.Fatalf("Failed to load keyring from '%v': %v", keyringPath, err)
+		}
+	}
+
+	if keyCacheSize > 0 {
+		keyCache = &dkim.KeyCache{MaxEntries: keyCacheSize}
 	}
 
 	parts := strings.SplitN(listenURI, "://", 2)
@@ -396,6 +540,10 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
+		if verbose && keyCache != nil {
+			stats := keyCache.Stats()
+			log.Printf("Public key cache: %v hits, %v misses", stats.Hits, stats.Misses)
+		}
 		if err := s.Close(); err != nil {
 			log.Fatal("Failed to close server: ", err)
 		}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-milter"
+	"github.com/sschekotikhin/go-msgauth/dkim"
+)
+
+func TestSession_noActiveKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signDomains = stringSliceFlag{"example.org"}
+	keyring = dkim.Keyring{Now: func() time.Time { return time.Unix(100, 0) }}
+	defer func() {
+		signDomains = nil
+		keyring = dkim.Keyring{}
+	}()
+	err = keyring.Add(&dkim.KeyringKey{
+		Domain:    "example.org",
+		Selector:  "brisbane",
+		Signer:    key,
+		NotBefore: time.Unix(200, 0),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error while adding key, got %v", err)
+	}
+
+	s := new(session)
+	if _, err := s.Header("From", "Joe SixPack <joe@example.org>", nil); err != nil {
+		t.Fatalf("Expected no error while processing header field, got %v", err)
+	}
+	resp, err := s.Headers(textproto.MIMEHeader{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error when no key is active, got %v", err)
+	} else if resp != milter.RespContinue {
+		t.Errorf("Expected message processing to continue, got %v", resp)
+	}
+	if s.signer != nil {
+		t.Error("Expected message not to be signed when no key is active")
+	}
+	s.closeVerifier()
+}
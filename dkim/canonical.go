@@ -1,9 +1,13 @@
 package dkim
 
 import (
+	"crypto"
+	"fmt"
+	"hash"
 	"io"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var rxReduceWS = regexp.MustCompile(`[ \t\r\n]+`)
@@ -16,14 +20,59 @@ const (
 	CanonicalizationRelaxed                  = "relaxed"
 )
 
-type canonicalizer interface {
+// Canonicalizer implements a canonicalization algorithm.
+type Canonicalizer interface {
+	// CanonicalizeHeader canonicalizes a header field. The header field
+	// contains its name, its value and the trailing CRLF.
 	CanonicalizeHeader(s string) string
+	// CanonicalizeBody returns a writer which canonicalizes a message body
+	// and writes the result to w. Close must be called once the whole body
+	// has been written.
 	CanonicalizeBody(w io.Writer) io.WriteCloser
 }
 
-var canonicalizers = map[Canonicalization]canonicalizer{
-	CanonicalizationSimple:  new(simpleCanonicalizer),
-	CanonicalizationRelaxed: new(relaxedCanonicalizer),
+var (
+	// SimpleCanonicalizer implements the "simple" canonicalization algorithm,
+	// defined in RFC 6376 sections 3.4.1 and 3.4.3.
+	SimpleCanonicalizer Canonicalizer = new(simpleCanonicalizer)
+	// RelaxedCanonicalizer implements the "relaxed" canonicalization
+	// algorithm, defined in RFC 6376 sections 3.4.2 and 3.4.4.
+	RelaxedCanonicalizer Canonicalizer = new(relaxedCanonicalizer)
+)
+
+var (
+	canonicalizersMu sync.RWMutex
+	canonicalizers   = map[Canonicalization]Canonicalizer{
+		CanonicalizationSimple:  SimpleCanonicalizer,
+		CanonicalizationRelaxed: RelaxedCanonicalizer,
+	}
+)
+
+// RegisterCanonicalizer makes a canonicalization algorithm available by name
+// to signers and verifiers. It panics if the name is invalid or already
+// registered, or if c is nil.
+func RegisterCanonicalizer(can Canonicalization, c Canonicalizer) {
+	if c == nil {
+		panic("dkim: nil canonicalizer")
+	}
+	if can == "" || strings.ContainsAny(string(can), "/;= \t\r\n") {
+		panic(fmt.Sprintf("dkim: invalid canonicalization name %q", can))
+	}
+
+	canonicalizersMu.Lock()
+	defer canonicalizersMu.Unlock()
+	if _, ok := canonicalizers[can]; ok {
+		panic(fmt.Sprintf("dkim: canonicalization %q already registered", can))
+	}
+	canonicalizers[can] = c
+}
+
+// LookupCanonicalizer returns the canonicalizer registered for an algorithm,
+// or nil if the algorithm is unknown.
+func LookupCanonicalizer(can Canonicalization) Canonicalizer {
+	canonicalizersMu.RLock()
+	defer canonicalizersMu.RUnlock()
+	return canonicalizers[can]
 }
 
 // crlfFixer fixes any lone LF without a preceding CR.
@@ -194,11 +243,96 @@ func (w *limitedWriter) Write(b []byte) (int, error) {
 
 	skipped := 0
 	if int64(len(b)) > w.N {
-		b = b[:w.N]
 		skipped = int(int64(len(b)) - w.N)
+		b = b[:w.N]
 	}
 
 	n, err := w.W.Write(b)
 	w.N -= int64(n)
 	return n + skipped, err
 }
+
+type countingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.W.Write(b)
+	w.N += int64(n)
+	return n, err
+}
+
+// bodyHashKey identifies a body hash computation. A negative limit means the
+// whole body is hashed.
+type bodyHashKey struct {
+	can   Canonicalization
+	hash  crypto.Hash
+	limit int64
+}
+
+// bodyHasherSet computes several body hashes in a single pass, once per
+// distinct bodyHashKey.
+type bodyHasherSet map[bodyHashKey]*bodyHasher
+
+// get returns the body hasher for k, creating it if necessary.
+func (s bodyHasherSet) get(k bodyHashKey) *bodyHasher {
+	bh, ok := s[k]
+	if !ok {
+		bh = newBodyHasher(k.can, k.hash, k.limit)
+		s[k] = bh
+	}
+	return bh
+}
+
+func (s bodyHasherSet) Write(b []byte) (int, error) {
+	for _, bh := range s {
+		if _, err := bh.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (s bodyHasherSet) Close() error {
+	for _, bh := range s {
+		if err := bh.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bodyHasher canonicalizes and hashes a message body.
+type bodyHasher struct {
+	io.WriteCloser
+	hasher  hash.Hash
+	counter *countingWriter
+}
+
+// newBodyHasher creates a new body hasher. If limit is non-negative, only the
+// first limit bytes of the canonicalized body are hashed.
+func newBodyHasher(can Canonicalization, h crypto.Hash, limit int64) *bodyHasher {
+	hasher := h.New()
+	var w io.Writer = hasher
+	if limit >= 0 {
+		w = &limitedWriter{W: hasher, N: limit}
+	}
+	counter := &countingWriter{W: w}
+	return &bodyHasher{
+		WriteCloser: LookupCanonicalizer(can).CanonicalizeBody(counter),
+		hasher:      hasher,
+		counter:     counter,
+	}
+}
+
+// Sum returns the body hash. It must be called after Close.
+func (bh *bodyHasher) Sum() []byte {
+	return bh.hasher.Sum(nil)
+}
+
+// Len returns the length of the whole canonicalized body, including bytes
+// past the limit. It must be called after Close.
+func (bh *bodyHasher) Len() int64 {
+	return bh.counter.N
+}
@@ -2,6 +2,9 @@ package dkim
 
 import (
 	"bytes"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -189,3 +192,88 @@ func TestRelaxedCanonicalizer_CanonicalBody_splitCRLF(t *testing.T) {
 		t.Errorf("Expected canonical body to be %q, but got %q", want, s)
 	}
 }
+
+// noWSPCanonicalizer is a custom canonicalization algorithm which removes all
+// whitespace from the body.
+type noWSPCanonicalizer struct {
+	relaxedCanonicalizer
+}
+
+type noWSPBodyCanonicalizer struct {
+	w io.Writer
+}
+
+func (c *noWSPBodyCanonicalizer) Write(b []byte) (int, error) {
+	_, err := c.w.Write([]byte(stripWhitespace(string(b))))
+	return len(b), err
+}
+
+func (c *noWSPBodyCanonicalizer) Close() error {
+	return nil
+}
+
+func (c *noWSPCanonicalizer) CanonicalizeBody(w io.Writer) io.WriteCloser {
+	return &noWSPBodyCanonicalizer{w}
+}
+
+var registerNoWSPOnce sync.Once
+
+func TestRegisterCanonicalizer(t *testing.T) {
+	const can Canonicalization = "x-nowsp"
+	registerNoWSPOnce.Do(func() {
+		RegisterCanonicalizer(can, new(noWSPCanonicalizer))
+	})
+
+	if LookupCanonicalizer(can) == nil {
+		t.Fatal("Expected registered canonicalizer to be found")
+	}
+
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:                 "example.org",
+		Selector:               "brisbane",
+		Signer:                 testPrivateKey,
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		BodyCanonicalization:   can,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	if !strings.Contains(b.String(), " c=relaxed/x-nowsp;") {
+		t.Errorf("Expected custom canonicalization in signature, got:\n%v", b.String())
+	}
+
+	altered := strings.Replace(b.String(), "Hi.", "H i .\t", 1)
+	verifications, err := Verify(strings.NewReader(altered))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
+func TestRegisterCanonicalizer_invalid(t *testing.T) {
+	tests := []struct {
+		name Canonicalization
+		c    Canonicalizer
+	}{
+		{CanonicalizationSimple, SimpleCanonicalizer},
+		{"", SimpleCanonicalizer},
+		{"a/b", SimpleCanonicalizer},
+		{"x-nil", nil},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected RegisterCanonicalizer(%q) to panic", test.name)
+				}
+			}()
+			RegisterCanonicalizer(test.name, test.c)
+		}()
+	}
+}
@@ -0,0 +1,147 @@
+package dkim
+
+import (
+	"errors"
+)
+
+// FailureReason describes why a signature failed to verify. Its value is
+// suitable as an Authentication-Results reason, see RFC 8601 section 2.3.
+//
+// FailureReason implements error, so that the errors returned by Verify can be
+// matched against the reasons below with errors.Is.
+type FailureReason string
+
+func (r FailureReason) Error() string {
+	return "dkim: " + string(r)
+}
+
+// Failure reasons, mostly from RFC 6376 sections 3.9 and 6.1.
+const (
+	ErrSignatureSyntax            FailureReason = "signature syntax error"
+	ErrIncompatibleVersion        FailureReason = "incompatible version"
+	ErrMissingRequiredTag         FailureReason = "signature missing required tag"
+	ErrDomainMismatch             FailureReason = "domain mismatch"
+	ErrFromNotSigned              FailureReason = "From field not signed"
+	ErrSignatureExpired           FailureReason = "signature expired"
+	ErrSignatureInFuture          FailureReason = "signature time is in the future"
+	ErrExpirationBeforeTime       FailureReason = "signature expiration is not after signature time"
+	ErrUnsupportedQueryMethod     FailureReason = "unsupported query method"
+	ErrUnsupportedAlgorithm       FailureReason = "unsupported algorithm"
+	ErrWeakAlgorithm              FailureReason = "algorithm too weak"
+	ErrInappropriateHashAlgorithm FailureReason = "inappropriate hash algorithm"
+	ErrInappropriateKeyAlgorithm  FailureReason = "inappropriate key algorithm"
+	ErrInappropriateService       FailureReason = "inappropriate service"
+	ErrBodyLength                 FailureReason = "insecure body length"
+	ErrBodyHashMismatch           FailureReason = "body hash did not verify"
+	ErrSignatureMismatch          FailureReason = "signature did not verify"
+	ErrNoKey                      FailureReason = "no key for signature"
+	ErrKeyUnavailable             FailureReason = "key unavailable"
+	ErrKeySyntax                  FailureReason = "key syntax error"
+	ErrKeyRevoked                 FailureReason = "key revoked"
+	ErrKeyTooShort                FailureReason = "key too short"
+	ErrLimitExceeded              FailureReason = "resource limit exceeded"
+)
+
+type errorKind int
+
+const (
+	kindFail errorKind = iota
+	kindPermFail
+	kindTempFail
+	kindPolicy
+)
+
+// Error is the error set in Verification.Err when a signature fails to
+// verify. It unwraps to its FailureReason.
+type Error struct {
+	// The reason why the signature failed to verify.
+	Reason FailureReason
+	// Additional details, if any.
+	Detail string
+
+	kind errorKind
+}
+
+func (err *Error) Error() string {
+	s := err.Reason.Error()
+	if err.Detail != "" {
+		s += ": " + err.Detail
+	}
+	return s
+}
+
+func (err *Error) Unwrap() error {
+	return err.Reason
+}
+
+// Permanent returns true if the error is a permanent failure, for instance a
+// missing required field or a malformed header. It corresponds to the
+// "permerror" Authentication-Results value.
+func (err *Error) Permanent() bool {
+	return err.kind == kindPermFail
+}
+
+// Temporary returns true if the error is a temporary failure. It corresponds
+// to the "temperror" Authentication-Results value.
+func (err *Error) Temporary() bool {
+	return err.kind == kindTempFail
+}
+
+// Policy returns true if the signature wasn't verified because of a local
+// policy, for instance a resource limit. It says nothing about the validity
+// of the signature, and corresponds to the "policy" Authentication-Results
+// value.
+func (err *Error) Policy() bool {
+	return err.kind == kindPolicy
+}
+
+func permFailError(reason FailureReason, detail string) error {
+	return &Error{Reason: reason, Detail: detail, kind: kindPermFail}
+}
+
+func tempFailError(reason FailureReason, detail string) error {
+	return &Error{Reason: reason, Detail: detail, kind: kindTempFail}
+}
+
+func failError(reason FailureReason, detail string) error {
+	return &Error{Reason: reason, Detail: detail, kind: kindFail}
+}
+
+func policyError(reason FailureReason, detail string) error {
+	return &Error{Reason: reason, Detail: detail, kind: kindPolicy}
+}
+
+// IsPermFail returns true if the error returned by Verify is a permanent
+// failure. A permanent failure is for instance a missing required field or a
+// malformed header.
+func IsPermFail(err error) bool {
+	var dkimErr *Error
+	return errors.As(err, &dkimErr) && dkimErr.Permanent()
+}
+
+// IsTempFail returns true if the error returned by Verify is a temporary
+// failure.
+func IsTempFail(err error) bool {
+	var dkimErr *Error
+	return errors.As(err, &dkimErr) && dkimErr.Temporary()
+}
+
+// IsFail returns true if the error returned by Verify is a signature error,
+// i.e. neither a permanent, a temporary nor a policy failure. It corresponds to
+// the "fail" Authentication-Results value.
+func IsFail(err error) bool {
+	var dkimErr *Error
+	return errors.As(err, &dkimErr) && dkimErr.kind == kindFail
+}
+
+// IsPolicyFail returns true if the error returned by Verify is caused by a
+// local policy rather than by the signature, for instance a resource limit
+// set in VerifyOptions.
+func IsPolicyFail(err error) bool {
+	var dkimErr *Error
+	return errors.As(err, &dkimErr) && dkimErr.Policy()
+}
+
+// ErrTooManySignatures is returned by Verify when the message exceeds the
+// maximum number of signatures.
+var ErrTooManySignatures = errors.New("dkim: too many signatures")
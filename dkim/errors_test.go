@@ -0,0 +1,163 @@
+package dkim
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason FailureReason
+		perm   bool
+		temp   bool
+		fail   bool
+		policy bool
+		msg    string
+	}{
+		{
+			err:    permFailError(ErrKeyRevoked, ""),
+			reason: ErrKeyRevoked,
+			perm:   true,
+			msg:    "dkim: key revoked",
+		},
+		{
+			err:    tempFailError(ErrKeyUnavailable, "i/o timeout"),
+			reason: ErrKeyUnavailable,
+			temp:   true,
+			msg:    "dkim: key unavailable: i/o timeout",
+		},
+		{
+			err:    failError(ErrBodyHashMismatch, ""),
+			reason: ErrBodyHashMismatch,
+			fail:   true,
+			msg:    "dkim: body hash did not verify",
+		},
+		{
+			err:    policyError(ErrLimitExceeded, "more than 1 DNS queries"),
+			reason: ErrLimitExceeded,
+			policy: true,
+			msg:    "dkim: resource limit exceeded: more than 1 DNS queries",
+		},
+	}
+	for _, test := range tests {
+		if !errors.Is(test.err, test.reason) {
+			t.Errorf("Expected %v to match reason %q", test.err, test.reason)
+		}
+		if errors.Is(test.err, ErrSignatureSyntax) {
+			t.Errorf("Expected %v not to match reason %q", test.err, ErrSignatureSyntax)
+		}
+
+		var dkimErr *Error
+		if !errors.As(test.err, &dkimErr) {
+			t.Fatalf("Expected %v to be an *Error", test.err)
+		} else if dkimErr.Reason != test.reason {
+			t.Errorf("Expected reason %q, got %q", test.reason, dkimErr.Reason)
+		}
+
+		if IsPermFail(test.err) != test.perm {
+			t.Errorf("Expected IsPermFail(%v) to be %v", test.err, test.perm)
+		}
+		if IsTempFail(test.err) != test.temp {
+			t.Errorf("Expected IsTempFail(%v) to be %v", test.err, test.temp)
+		}
+		if IsFail(test.err) != test.fail {
+			t.Errorf("Expected IsFail(%v) to be %v", test.err, test.fail)
+		}
+		if IsPolicyFail(test.err) != test.policy {
+			t.Errorf("Expected IsPolicyFail(%v) to be %v", test.err, test.policy)
+		}
+		if msg := test.err.Error(); msg != test.msg {
+			t.Errorf("Expected error message %q, got %q", test.msg, msg)
+		}
+	}
+}
+
+func TestVerify_failureReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		mail   string
+		reason FailureReason
+	}{
+		{
+			name:   "from not signed",
+			mail:   strings.Replace(verifiedMailString, "h=Received : From : To", "h=Received : To", 1),
+			reason: ErrFromNotSigned,
+		},
+		{
+			name:   "body hash mismatch",
+			mail:   strings.Replace(verifiedMailString, "Hi.", "Bye.", 1),
+			reason: ErrBodyHashMismatch,
+		},
+		{
+			name:   "signature mismatch",
+			mail:   strings.Replace(verifiedMailString, "Is dinner ready?", "Is lunch ready?", 1),
+			reason: ErrSignatureMismatch,
+		},
+		{
+			name:   "domain mismatch",
+			mail:   strings.Replace(verifiedMailString, "i=joe@football.example.com", "i=joe@example.net", 1),
+			reason: ErrDomainMismatch,
+		},
+		// The following cases have several problems, only the first one
+		// checked is reported
+		{
+			name:   "malformed algorithm before key hash algorithm",
+			mail:   replaceSignatureTags(verifiedMailString, "a=rsa-sha256", "a=rsa", "s=brisbane", "s=sha256"),
+			reason: ErrSignatureSyntax,
+		},
+		{
+			name:   "key hash algorithm before weak hash algorithm",
+			mail:   replaceSignatureTags(verifiedMailString, "a=rsa-sha256", "a=rsa-sha1", "s=brisbane", "s=sha256"),
+			reason: ErrInappropriateHashAlgorithm,
+		},
+		{
+			name:   "weak hash algorithm before key algorithm",
+			mail:   replaceSignatureTags(verifiedMailString, "a=rsa-sha256", "a=ed25519-sha1"),
+			reason: ErrWeakAlgorithm,
+		},
+		{
+			name:   "key algorithm before service",
+			mail:   replaceSignatureTags(verifiedMailString, "a=rsa-sha256", "a=ed25519-sha256", "s=brisbane", "s=service"),
+			reason: ErrInappropriateKeyAlgorithm,
+		},
+		{
+			name:   "service before body canonicalization",
+			mail:   replaceSignatureTags(verifiedMailString, "c=simple/simple", "c=simple/unknown", "s=brisbane", "s=service"),
+			reason: ErrInappropriateService,
+		},
+		{
+			name:   "body canonicalization before body length",
+			mail:   replaceSignatureTags(verifiedMailString, "c=simple/simple", "c=simple/unknown; l=3"),
+			reason: ErrUnsupportedAlgorithm,
+		},
+		{
+			name:   "body length",
+			mail:   replaceSignatureTags(verifiedMailString, "c=simple/simple", "c=simple/simple; l=3"),
+			reason: ErrBodyLength,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifications, err := Verify(newMailStringReader(test.mail))
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+			if err := verifications[0].Err; !errors.Is(err, test.reason) {
+				t.Errorf("Expected reason %q, got: %v", test.reason, err)
+			}
+		})
+	}
+}
+
+// replaceSignatureTags applies replacements given as old, new pairs to the
+// first occurrence in a mail.
+func replaceSignatureTags(mail string, oldnew ...string) string {
+	for i := 0; i < len(oldnew); i += 2 {
+		mail = strings.Replace(mail, oldnew[i], oldnew[i+1], 1)
+	}
+	return mail
+}
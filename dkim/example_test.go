@@ -2,16 +2,16 @@ package dkim_test
 
 import (
 	"bytes"
+	"crypto"
 	"log"
 	"strings"
 
 	"github.com/sschekotikhin/go-msgauth/dkim"
-	"github.com/sschekotikhin/openssl"
 )
 
 var (
 	mailString string
-	privateKey openssl.PrivateKey
+	privateKey crypto.Signer
 )
 
 func ExampleSign() {
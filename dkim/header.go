@@ -1,13 +1,12 @@
 package dkim
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"net/textproto"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -15,27 +14,74 @@ const crlf = "\r\n"
 
 type header []string
 
-func readHeader(r *bufio.Reader) (header, error) {
-	tr := textproto.NewReader(r)
+// headerParser incrementally parses a message header.
+type headerParser struct {
+	buf  []byte // incomplete line
+	cur  []byte // current field, appended to h when the next one starts
+	h    header
+	done bool
+}
 
-	var h header
-	for {
-		l, err := tr.ReadLine()
-		if err != nil {
-			return h, fmt.Errorf("failed to read header: %v", err)
+func (p *headerParser) reset() {
+	p.buf = p.buf[:0]
+	p.cur = p.cur[:0]
+	p.h = p.h[:0]
+	p.done = false
+}
+
+// fields returns the number of header fields parsed so far, including the
+// current one.
+func (p *headerParser) fields() int {
+	if len(p.cur) > 0 {
+		return len(p.h) + 1
+	}
+	return len(p.h)
+}
+
+func (p *headerParser) flush() {
+	if len(p.cur) > 0 {
+		p.h = append(p.h, string(p.cur))
+		p.cur = p.cur[:0]
+	}
+}
+
+// parse consumes header data from b. It returns the number of bytes
+// consumed: when the end of the header is reached, the remaining bytes belong
+// to the body.
+func (p *headerParser) parse(b []byte) int {
+	n := 0
+	for !p.done {
+		i := bytes.IndexByte(b[n:], '\n')
+		if i < 0 {
+			p.buf = append(p.buf, b[n:]...)
+			return len(b)
+		}
+
+		line := b[n : n+i]
+		n += i + 1
+		if len(p.buf) > 0 {
+			p.buf = append(p.buf, line...)
+			line = p.buf
 		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
 
-		if len(l) == 0 {
-			break
-		} else if len(h) > 0 && (l[0] == ' ' || l[0] == '\t') {
+		// Fields are only converted to strings once complete, so that
+		// continuation lines don't copy the whole field each time
+		if len(line) == 0 {
+			p.flush()
+			p.done = true
+		} else if len(p.cur) > 0 && (line[0] == ' ' || line[0] == '\t') {
 			// This is a continuation line
-			h[len(h)-1] += l + crlf
+			p.cur = append(p.cur, line...)
+			p.cur = append(p.cur, crlf...)
 		} else {
-			h = append(h, l+crlf)
+			p.flush()
+			p.cur = append(p.cur, line...)
+			p.cur = append(p.cur, crlf...)
 		}
+		p.buf = p.buf[:0]
 	}
-
-	return h, nil
+	return n
 }
 
 func writeHeader(w io.Writer, h header) error {
@@ -136,6 +182,105 @@ func sortParams(params map[string]string) ([]string, string, bool) {
 	return keys, bvalue, bfound
 }
 
+// formatCopiedHeaderFields formats header fields as a "z=" tag value, as
+// specified in RFC 6376 section 3.5.
+func formatCopiedHeaderFields(fields []string) string {
+	copies := make([]string, len(fields))
+	for i, kv := range fields {
+		kv = strings.TrimSuffix(kv, crlf)
+		parts := strings.SplitN(kv, ":", 2)
+		k := strings.TrimSpace(parts[0])
+		var v string
+		if len(parts) > 1 {
+			v = parts[1]
+		}
+		copies[i] = k + ":" + encodeQuotedPrintable(v)
+	}
+	return foldQuotedPrintable(strings.Join(copies, "|"))
+}
+
+// parseCopiedHeaderFields parses a "z=" tag value. It returns the copied
+// header fields, each one terminated by a CRLF.
+func parseCopiedHeaderFields(s string) (header, error) {
+	var fields header
+	for _, c := range strings.Split(s, "|") {
+		kv := strings.SplitN(stripWhitespace(c), ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("dkim: malformed copied header field")
+		}
+		v, err := decodeQuotedPrintable(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, kv[0]+":"+v+crlf)
+	}
+	return fields, nil
+}
+
+// encodeQuotedPrintable encodes a header value with the DKIM-Quoted-Printable
+// encoding (RFC 6376 section 2.11). The "|" character is also encoded, as
+// required by the "z=" tag.
+func encodeQuotedPrintable(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 0x21 && ch <= 0x3A) || ch == 0x3C || (ch >= 0x3E && ch <= 0x7E && ch != '|') {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "=%02X", ch)
+		}
+	}
+	return sb.String()
+}
+
+// decodeQuotedPrintable decodes a DKIM-Quoted-Printable string. Whitespace is
+// ignored.
+func decodeQuotedPrintable(s string) (string, error) {
+	s = stripWhitespace(s)
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("dkim: malformed quoted-printable string")
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("dkim: malformed quoted-printable string")
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// foldQuotedPrintable folds a long DKIM-Quoted-Printable string. Folding
+// whitespace is ignored when decoding.
+func foldQuotedPrintable(s string) string {
+	var sb strings.Builder
+	n := 0
+	for i := 0; i < len(s); i++ {
+		// Don't split encoded octets
+		if n >= 70 && (i < 2 || (s[i-1] != '=' && s[i-2] != '=')) {
+			sb.WriteString("\r\n ")
+			n = 0
+		}
+		sb.WriteByte(s[i])
+		n++
+	}
+	return sb.String()
+}
+
+func reverseHeader(h header) header {
+	r := make(header, len(h))
+	for i, kv := range h {
+		r[len(h)-1-i] = kv
+	}
+	return r
+}
+
 type headerPicker struct {
 	h      header
 	picked map[string]int
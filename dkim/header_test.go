@@ -1,8 +1,8 @@
 package dkim
 
 import (
-	"bufio"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -26,25 +26,11 @@ var headerTests = []struct {
 	},
 }
 
-func TestReadHeader(t *testing.T) {
-	for _, test := range headerTests {
-		r := strings.NewReader(test.s)
-		h, err := readHeader(bufio.NewReader(r))
-		if err != nil {
-			t.Fatalf("Expected no error while reading error, got: %v", err)
-		}
-
-		if !reflect.DeepEqual(h, test.h) {
-			t.Errorf("Expected header to be \n%v\n but got \n%v", test.h, h)
-		}
-	}
-}
-
-func TestReadHeader_incomplete(t *testing.T) {
-	r := strings.NewReader("From: <mistuha@kiminonawa.moe>\r\nTo")
-	_, err := readHeader(bufio.NewReader(r))
-	if err == nil {
-		t.Error("Expected an error while reading incomplete header")
+func TestHeaderParser_incomplete(t *testing.T) {
+	var p headerParser
+	p.parse([]byte("From: <mistuha@kiminonawa.moe>\r\nTo"))
+	if p.done {
+		t.Error("Expected end of header not to be reached for an incomplete header")
 	}
 }
 
@@ -146,3 +132,118 @@ func TestFoldHeaderField(t *testing.T) {
 		t.Errorf("Extra black line added in header:\n Actual:\n ---Start--- %v ---End---\nExpected: \n ---Start--- %v ---End---\n", folded, expected)
 	}
 }
+
+func TestHeaderParser(t *testing.T) {
+	const body = "Hi.\r\n"
+	for _, test := range headerTests {
+		// Feed the parser one byte at a time, to make sure lines spanning
+		// several writes are handled
+		var p headerParser
+		s := test.s + body
+		var rest string
+		for i := 0; i < len(s); i++ {
+			if n := p.parse([]byte{s[i]}); n == 0 {
+				rest = s[i:]
+				break
+			}
+		}
+
+		if !p.done {
+			t.Fatalf("Expected end of header to be reached")
+		}
+		if !reflect.DeepEqual(p.h, test.h) {
+			t.Errorf("Expected header to be \n%v\n but got \n%v", test.h, p.h)
+		}
+		if rest != body {
+			t.Errorf("Expected body to be %q, got %q", body, rest)
+		}
+	}
+}
+
+var quotedPrintableTests = []struct {
+	raw     string
+	encoded string
+}{
+	{"", ""},
+	{"joe@football.example.com", "joe@football.example.com"},
+	{" Is dinner ready?", "=20Is=20dinner=20ready?"},
+	{"a=b; c|d", "a=3Db=3B=20c=7Cd"},
+	{"line\r\n\tfolded", "line=0D=0A=09folded"},
+}
+
+func TestEncodeQuotedPrintable(t *testing.T) {
+	for _, test := range quotedPrintableTests {
+		if s := encodeQuotedPrintable(test.raw); s != test.encoded {
+			t.Errorf("Expected %q to be encoded as %q, got %q", test.raw, test.encoded, s)
+		}
+	}
+}
+
+func TestDecodeQuotedPrintable(t *testing.T) {
+	for _, test := range quotedPrintableTests {
+		s, err := decodeQuotedPrintable(test.encoded)
+		if err != nil {
+			t.Errorf("Expected no error while decoding %q, got: %v", test.encoded, err)
+		} else if s != test.raw {
+			t.Errorf("Expected %q to be decoded as %q, got %q", test.encoded, test.raw, s)
+		}
+	}
+
+	if _, err := decodeQuotedPrintable("abc=2"); err == nil {
+		t.Error("Expected an error while decoding a truncated octet")
+	}
+}
+
+func TestCopiedHeaderFields(t *testing.T) {
+	h := header{
+		"From: Joe SixPack <joe@football.example.com>\r\n",
+		"Subject: Is dinner ready? |" + strings.Repeat("x", 100) + "\r\n",
+	}
+
+	z := formatCopiedHeaderFields(h)
+	for _, l := range strings.Split(z, "\r\n") {
+		if len(l) > 78 {
+			t.Errorf("Expected copied header fields to be folded, got line %q", l)
+		}
+	}
+
+	copies, err := parseCopiedHeaderFields(z)
+	if err != nil {
+		t.Fatalf("Expected no error while parsing copied header fields, got: %v", err)
+	}
+	if !reflect.DeepEqual(copies, h) {
+		t.Errorf("Expected copied header fields to be \n%v\n but got \n%v", h, copies)
+	}
+}
+
+// foldedHeader returns a header with a single field folded over n lines.
+func foldedHeader(n int) string {
+	return "X-Folded: a\r\n" + strings.Repeat(" a\r\n", n-1) + "\r\n"
+}
+
+func TestHeaderParser_longFoldedField(t *testing.T) {
+	const n = 100000
+	var p headerParser
+	if consumed := p.parse([]byte(foldedHeader(n))); !p.done || consumed != len(foldedHeader(n)) {
+		t.Fatalf("Expected the whole header to be parsed")
+	}
+	if len(p.h) != 1 {
+		t.Fatalf("Expected a single header field, got %v", len(p.h))
+	}
+	if want := "X-Folded: a\r\n" + strings.Repeat(" a\r\n", n-1); p.h[0] != want {
+		t.Errorf("Unexpected header field of length %v, want length %v", len(p.h[0]), len(want))
+	}
+}
+
+func BenchmarkHeaderParser_foldedField(b *testing.B) {
+	for _, n := range []int{40000, 80000} {
+		s := []byte(foldedHeader(n))
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(len(s)))
+			for i := 0; i < b.N; i++ {
+				var p headerParser
+				p.parse(s)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package dkim
+
+import (
+	"strings"
+)
+
+// HeaderPreset is a named set of header fields to sign, used when
+// SignOptions.HeaderKeys is nil.
+type HeaderPreset string
+
+const (
+	// The header fields recommended by RFC 6376 section 5.4.1, along with
+	// Message-ID and Sender.
+	HeaderPresetRecommended HeaderPreset = "recommended"
+	// The MIME header fields describing the message content.
+	HeaderPresetMIME HeaderPreset = "mime"
+	// All header fields, except trace and volatile fields.
+	HeaderPresetAll HeaderPreset = "all"
+)
+
+var defaultHeaderPresets = []HeaderPreset{HeaderPresetRecommended, HeaderPresetMIME}
+
+var headerPresets = map[HeaderPreset][]string{
+	HeaderPresetRecommended: {
+		"From",
+		"Reply-To",
+		"Subject",
+		"Date",
+		"To",
+		"Cc",
+		"Resent-Date",
+		"Resent-From",
+		"Resent-To",
+		"Resent-Cc",
+		"In-Reply-To",
+		"References",
+		"List-Id",
+		"List-Help",
+		"List-Unsubscribe",
+		"List-Subscribe",
+		"List-Post",
+		"List-Owner",
+		"List-Archive",
+		"Message-ID",
+		"Sender",
+	},
+	HeaderPresetMIME: {
+		"MIME-Version",
+		"Content-Type",
+		"Content-Transfer-Encoding",
+		"Content-ID",
+		"Content-Description",
+		"Content-Disposition",
+		"Content-Language",
+	},
+	HeaderPresetAll: nil,
+}
+
+// unsignedHeaderKeys contains trace header fields and header fields commonly
+// added or altered in transit. They are never selected by a HeaderPreset.
+//
+// See RFC 6376 section 5.4.1.
+var unsignedHeaderKeys = []string{
+	"Return-Path",
+	"Received",
+	"Comments",
+	"Keywords",
+	"Delivered-To",
+	"X-Original-To",
+	"Received-SPF",
+	"Authentication-Results",
+	"DKIM-Signature",
+	"ARC-Seal",
+	"ARC-Message-Signature",
+	"ARC-Authentication-Results",
+}
+
+// selectHeaderKeys returns the names of the header fields of h selected by
+// presets, in the order they appear in h. The From header field is always
+// selected.
+func selectHeaderKeys(h header, presets []HeaderPreset) []string {
+	if presets == nil {
+		presets = defaultHeaderPresets
+	}
+
+	all := false
+	selected := []string{"From"}
+	for _, p := range presets {
+		if p == HeaderPresetAll {
+			all = true
+		}
+		selected = append(selected, headerPresets[p]...)
+	}
+
+	var keys []string
+	for _, kv := range h {
+		k, _ := parseHeaderField(kv)
+		if hasHeaderKey(unsignedHeaderKeys, k) {
+			continue
+		}
+		if all || hasHeaderKey(selected, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func hasHeaderKey(keys []string, name string) bool {
+	for _, k := range keys {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package dkim
+
+import (
+	"reflect"
+	"testing"
+)
+
+var selectHeaderKeysHeader = header{
+	"Return-Path: <joe@football.example.com>\r\n",
+	"Received: from client1.football.example.com  [192.0.2.1]\r\n",
+	"Authentication-Results: example.net; dkim=pass\r\n",
+	"DKIM-Signature: v=1; a=rsa-sha256; d=example.net; s=brisbane\r\n",
+	"From: Joe SixPack <joe@football.example.com>\r\n",
+	"To: Suzie Q <suzie@shopping.example.net>\r\n",
+	"Subject: Is dinner ready?\r\n",
+	"MIME-Version: 1.0\r\n",
+	"Content-Type: text/plain\r\n",
+	"X-Mailer: Pigeon 1.0\r\n",
+}
+
+var selectHeaderKeysTests = []struct {
+	presets []HeaderPreset
+	keys    []string
+}{
+	{
+		presets: nil,
+		keys:    []string{"From", "To", "Subject", "MIME-Version", "Content-Type"},
+	},
+	{
+		presets: []HeaderPreset{HeaderPresetRecommended},
+		keys:    []string{"From", "To", "Subject"},
+	},
+	{
+		presets: []HeaderPreset{HeaderPresetMIME},
+		keys:    []string{"From", "MIME-Version", "Content-Type"},
+	},
+	{
+		presets: []HeaderPreset{HeaderPresetAll},
+		keys:    []string{"From", "To", "Subject", "MIME-Version", "Content-Type", "X-Mailer"},
+	},
+}
+
+func TestSelectHeaderKeys(t *testing.T) {
+	for _, test := range selectHeaderKeysTests {
+		keys := selectHeaderKeys(selectHeaderKeysHeader, test.presets)
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("Expected header keys for presets %v to be %v, got %v", test.presets, test.keys, keys)
+		}
+	}
+}
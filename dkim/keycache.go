@@ -0,0 +1,217 @@
+package dkim
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeyCacheSize        = 1024
+	defaultKeyCacheTTL         = time.Hour
+	defaultKeyCacheNegativeTTL = 5 * time.Minute
+)
+
+// KeyCache caches public keys across verifications. Failed lookups are cached
+// too, except temporary failures. Concurrent lookups of the same key which
+// isn't cached are collapsed into a single query.
+//
+// A KeyCache is safe for concurrent use. The zero value is an empty cache
+// with default settings.
+type KeyCache struct {
+	// MaxEntries is the maximum number of cached keys. When the cache is full,
+	// the least recently used key is evicted. If zero, 1024 keys are cached.
+	MaxEntries int
+	// TTL is the duration during which keys are cached, when the resolver
+	// doesn't implement TTLResolver. If zero, keys are cached for an hour.
+	TTL time.Duration
+	// NegativeTTL is the maximum duration during which missing, revoked or
+	// invalid keys are cached. If zero, they are cached for 5 minutes.
+	NegativeTTL time.Duration
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	pending map[string]*keyCacheCall
+	hits    uint64
+	misses  uint64
+}
+
+// keyCacheCall is a pending query. done is closed once res and err are set.
+type keyCacheCall struct {
+	done chan struct{}
+	res  *queryResult
+	err  error
+}
+
+type keyCacheEntry struct {
+	name    string
+	res     *queryResult
+	err     error
+	expires time.Time
+}
+
+// KeyCacheStats contains KeyCache statistics.
+type KeyCacheStats struct {
+	// The number of lookups served from the cache, including the ones which
+	// waited for a pending query of the same key.
+	Hits uint64
+	// The number of lookups which weren't cached or had expired.
+	Misses uint64
+	// The number of cached keys, including expired ones.
+	Entries int
+}
+
+// Stats returns cache statistics.
+func (c *KeyCache) Stats() KeyCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return KeyCacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.lru.Len(),
+	}
+}
+
+// Purge removes all keys from the cache.
+func (c *KeyCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.lru.Init()
+}
+
+func (c *KeyCache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return now()
+}
+
+// get returns the cached entry for name. If there is none, it returns the
+// pending query for name, if any. Otherwise, it registers a new pending query
+// which must be completed with done.
+func (c *KeyCache) get(name string, t time.Time) (entry *keyCacheEntry, call *keyCacheCall, pending bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[name]; ok {
+		entry := elem.Value.(*keyCacheEntry)
+		if t.Before(entry.expires) {
+			c.hits++
+			c.lru.MoveToFront(elem)
+			return entry, nil, false
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, name)
+	}
+
+	if call, ok := c.pending[name]; ok {
+		c.hits++
+		return nil, call, true
+	}
+
+	c.misses++
+	if c.pending == nil {
+		c.pending = make(map[string]*keyCacheCall)
+	}
+	call = &keyCacheCall{done: make(chan struct{})}
+	c.pending[name] = call
+	return nil, call, false
+}
+
+// done completes the pending query for name, and caches its result if entry
+// isn't nil.
+func (c *KeyCache) done(name string, call *keyCacheCall, entry *keyCacheEntry) {
+	if entry != nil {
+		c.put(entry)
+	}
+
+	c.mu.Lock()
+	delete(c.pending, name)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+func (c *KeyCache) put(entry *keyCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if elem, ok := c.entries[entry.name]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.name] = c.lru.PushFront(entry)
+
+	max := c.MaxEntries
+	if max <= 0 {
+		max = defaultKeyCacheSize
+	}
+	for c.lru.Len() > max {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.entries, elem.Value.(*keyCacheEntry).name)
+	}
+}
+
+func (c *KeyCache) query(ctx context.Context, method QueryMethod, query queryFunc, domain, selector string, txtLookup txtLookupFunc) (*queryResult, error) {
+	name := string(method) + ":" + strings.ToLower(selector+"._domainkey."+domain)
+	for {
+		t := c.now()
+		entry, call, pending := c.get(name, t)
+		if entry != nil {
+			return entry.res, entry.err
+		} else if !pending {
+			return c.queryAndPut(ctx, name, call, t, query, domain, selector, txtLookup)
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, tempFailError(ErrKeyUnavailable, ctx.Err().Error())
+		}
+		// A temporary failure may be caused by the context of the other
+		// lookup, retry with ours
+		if !IsTempFail(call.err) || ctx.Err() != nil {
+			return call.res, call.err
+		}
+	}
+}
+
+func (c *KeyCache) queryAndPut(ctx context.Context, name string, call *keyCacheCall, t time.Time, query queryFunc, domain, selector string, txtLookup txtLookupFunc) (*queryResult, error) {
+	res, ttl, err := query(ctx, domain, selector, txtLookup)
+	call.res, call.err = res, err
+	if IsTempFail(err) {
+		c.done(name, call, nil)
+		return res, err
+	}
+
+	if err != nil {
+		negTTL := c.NegativeTTL
+		if negTTL <= 0 {
+			negTTL = defaultKeyCacheNegativeTTL
+		}
+		if ttl <= 0 || ttl > negTTL {
+			ttl = negTTL
+		}
+	} else if ttl <= 0 {
+		ttl = c.TTL
+		if ttl <= 0 {
+			ttl = defaultKeyCacheTTL
+		}
+	}
+
+	c.done(name, call, &keyCacheEntry{
+		name:    name,
+		res:     res,
+		err:     err,
+		expires: t.Add(ttl),
+	})
+	return res, err
+}
@@ -0,0 +1,182 @@
+package dkim
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testResolver struct {
+	records map[string]string
+	ttl     time.Duration
+	lookups int
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	txts, _, err := r.LookupTXTWithTTL(ctx, domain)
+	return txts, err
+}
+
+func (r *testResolver) LookupTXTWithTTL(ctx context.Context, domain string) ([]string, time.Duration, error) {
+	r.lookups++
+	switch txt, ok := r.records[domain]; {
+	case domain == "timeout._domainkey.example.org":
+		return nil, 0, &net.DNSError{Err: "timeout", Name: domain, IsTimeout: true, IsTemporary: true}
+	case !ok:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	default:
+		return []string{txt}, r.ttl, nil
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	current := time.Unix(424242, 0)
+	cache := &KeyCache{
+		NegativeTTL: time.Minute,
+		Now:         func() time.Time { return current },
+	}
+	resolver := &testResolver{
+		records: map[string]string{
+			"brisbane._domainkey.example.org": dnsPublicKey,
+			"revoked._domainkey.example.org":  "v=DKIM1; p=",
+		},
+		ttl: 10 * time.Minute,
+	}
+
+	txtLookup := (&VerifyOptions{Resolver: resolver}).txtLookup()
+	query := func(selector string) error {
+		_, err := cache.query(context.Background(), QueryMethodDNSTXT, queryDNSTXT, "example.org", selector, txtLookup)
+		return err
+	}
+
+	tests := []struct {
+		selector string
+		advance  time.Duration
+		lookups  int
+		reason   FailureReason
+	}{
+		{"brisbane", 0, 1, ""},
+		{"BRISBANE", 0, 1, ""},
+		{"brisbane", 9 * time.Minute, 1, ""},
+		{"brisbane", time.Minute, 2, ""}, // expired
+		{"missing", 0, 3, ErrNoKey},
+		{"missing", 30 * time.Second, 3, ErrNoKey},
+		{"revoked", 0, 4, ErrKeyRevoked},
+		{"revoked", 30 * time.Second, 4, ErrKeyRevoked},
+		{"revoked", time.Minute, 5, ErrKeyRevoked}, // negative TTL expired
+		{"timeout", 0, 6, ErrKeyUnavailable},
+		{"timeout", 0, 7, ErrKeyUnavailable}, // temporary failures aren't cached
+	}
+	for i, test := range tests {
+		current = current.Add(test.advance)
+		err := query(test.selector)
+		if test.reason == "" && err != nil {
+			t.Errorf("Test %v: expected no error, got %v", i, err)
+		} else if test.reason != "" && !errors.Is(err, test.reason) {
+			t.Errorf("Test %v: expected reason %q, got %v", i, test.reason, err)
+		}
+		if resolver.lookups != test.lookups {
+			t.Errorf("Test %v: expected %v lookups, got %v", i, test.lookups, resolver.lookups)
+		}
+	}
+
+	want := KeyCacheStats{Hits: 4, Misses: 7, Entries: 3}
+	if stats := cache.Stats(); stats != want {
+		t.Errorf("Expected stats %+v, got %+v", want, stats)
+	}
+
+	cache.Purge()
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Errorf("Expected no entries after purge, got %v", stats.Entries)
+	}
+}
+
+func TestKeyCache_maxEntries(t *testing.T) {
+	cache := &KeyCache{MaxEntries: 2}
+	resolver := &testResolver{
+		records: map[string]string{
+			"a._domainkey.example.org": dnsPublicKey,
+			"b._domainkey.example.org": dnsPublicKey,
+			"c._domainkey.example.org": dnsPublicKey,
+		},
+	}
+
+	for _, selector := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := cache.query(context.Background(), QueryMethodDNSTXT, queryDNSTXT, "example.org", selector, (&VerifyOptions{Resolver: resolver}).txtLookup()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	// "b" is evicted when "c" is added, since "a" was used more recently
+	want := KeyCacheStats{Hits: 2, Misses: 4, Entries: 2}
+	if stats := cache.Stats(); stats != want {
+		t.Errorf("Expected stats %+v, got %+v", want, stats)
+	}
+}
+
+func TestVerifyWithOptions_keyCache(t *testing.T) {
+	options := &VerifyOptions{KeyCache: new(KeyCache)}
+
+	for i := 0; i < 3; i++ {
+		verifications, err := VerifyWithOptions(strings.NewReader(verifiedMailString), options)
+		if err != nil {
+			t.Fatalf("Expected no error while verifying signature, got: %v", err)
+		} else if len(verifications) != 1 {
+			t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+		} else if err := verifications[0].Err; err != nil {
+			t.Errorf("Expected no error when verifying signature, got: %v", err)
+		}
+	}
+
+	want := KeyCacheStats{Hits: 2, Misses: 1, Entries: 1}
+	if stats := options.KeyCache.Stats(); stats != want {
+		t.Errorf("Expected stats %+v, got %+v", want, stats)
+	}
+}
+
+// countingResolver counts lookups, which take some time so that concurrent
+// lookups overlap.
+type countingResolver struct {
+	lookups int32
+}
+
+func (r *countingResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	time.Sleep(20 * time.Millisecond)
+	return []string{dnsPublicKey}, nil
+}
+
+func TestVerifyWithOptions_keyCacheConcurrentLookups(t *testing.T) {
+	queryMethods["dns/txt"] = queryDNSTXT
+	defer func() { queryMethods["dns/txt"] = queryTest }()
+
+	var options []*SignOptions
+	for i := 0; i < 5; i++ {
+		options = append(options, &SignOptions{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey})
+	}
+	signed := signMultipleTimes(t, options)
+
+	resolver := new(countingResolver)
+	verifyOptions := &VerifyOptions{Resolver: resolver, KeyCache: new(KeyCache)}
+	verifications, err := VerifyWithOptions(strings.NewReader(signed), verifyOptions)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signatures, got: %v", err)
+	}
+	for i, v := range verifications {
+		if v.Err != nil {
+			t.Errorf("Expected no error when verifying signature #%v, got: %v", i, v.Err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&resolver.lookups); n != 1 {
+		t.Errorf("Expected a single lookup, got %v", n)
+	}
+	want := KeyCacheStats{Hits: 4, Misses: 1, Entries: 1}
+	if stats := verifyOptions.KeyCache.Stats(); stats != want {
+		t.Errorf("Expected stats %+v, got %+v", want, stats)
+	}
+}
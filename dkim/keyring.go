@@ -0,0 +1,190 @@
+package dkim
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyState is the state of a key in a Keyring at a given time.
+type KeyState int
+
+const (
+	// The key isn't active yet.
+	KeyPending KeyState = iota
+	// The key can be used for signing.
+	KeyActive
+	// The key has been retired. Its public key record should be revoked.
+	KeyRetired
+)
+
+func (s KeyState) String() string {
+	switch s {
+	case KeyPending:
+		return "pending"
+	case KeyActive:
+		return "active"
+	case KeyRetired:
+		return "retired"
+	}
+	return fmt.Sprintf("KeyState(%d)", int(s))
+}
+
+// KeyringKey is a signing key held in a Keyring.
+type KeyringKey struct {
+	// The SDID the key signs for. "*" matches any domain.
+	Domain string
+	// The selector under which the public key is published.
+	Selector string
+	// The private key. Exactly one of Signer and DigestSigner must be set,
+	// see SignOptions.
+	Signer       crypto.Signer
+	DigestSigner DigestSigner
+
+	// The time from which the key can be used. A zero value means the key is
+	// active immediately.
+	NotBefore time.Time
+	// The time from which the key is retired. A zero value means the key is
+	// never retired.
+	NotAfter time.Time
+}
+
+// State returns the state of the key at time t.
+func (k *KeyringKey) State(t time.Time) KeyState {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return KeyPending
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return KeyRetired
+	}
+	return KeyActive
+}
+
+// Keyring holds signing keys for one or several domains, and picks the one to
+// use based on the current time. This allows keys to be rotated without
+// reconfiguring signers.
+//
+// A Keyring is safe for concurrent use.
+type Keyring struct {
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu   sync.RWMutex
+	keys []*KeyringKey
+}
+
+func (kr *Keyring) now() time.Time {
+	if kr.Now != nil {
+		return kr.Now()
+	}
+	return now()
+}
+
+// Add adds a key to the keyring.
+func (kr *Keyring) Add(k *KeyringKey) error {
+	if k.Domain == "" {
+		return fmt.Errorf("dkim: no domain specified")
+	}
+	if k.Selector == "" {
+		return fmt.Errorf("dkim: no selector specified")
+	}
+	if k.Signer == nil && k.DigestSigner == nil {
+		return fmt.Errorf("dkim: no signer specified")
+	}
+	if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotBefore.Before(k.NotAfter) {
+		return fmt.Errorf("dkim: key for selector %q is retired before being active", k.Selector)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for _, other := range kr.keys {
+		if strings.EqualFold(other.Domain, k.Domain) && other.Selector == k.Selector {
+			return fmt.Errorf("dkim: duplicate selector %q for domain %q", k.Selector, k.Domain)
+		}
+	}
+	kr.keys = append(kr.keys, k)
+	return nil
+}
+
+// Keys returns all keys for a domain, including pending and retired ones. If
+// domain is empty, all keys are returned.
+func (kr *Keyring) Keys(domain string) []*KeyringKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	var l []*KeyringKey
+	for _, k := range kr.keys {
+		if domain == "" || k.matches(domain) {
+			l = append(l, k)
+		}
+	}
+	return l
+}
+
+// Retired returns the retired keys for a domain. Their public key records
+// should be revoked by publishing an empty "p=" tag. If domain is empty,
+// retired keys for all domains are returned.
+func (kr *Keyring) Retired(domain string) []*KeyringKey {
+	t := kr.now()
+	var l []*KeyringKey
+	for _, k := range kr.Keys(domain) {
+		if k.State(t) == KeyRetired {
+			l = append(l, k)
+		}
+	}
+	return l
+}
+
+// Key returns the key to use to sign messages for a domain. If several keys
+// are active, the most recently activated one is returned. Keys registered
+// for the exact domain take precedence over wildcard keys.
+func (kr *Keyring) Key(domain string) (*KeyringKey, error) {
+	t := kr.now()
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	var best *KeyringKey
+	for _, k := range kr.keys {
+		if !k.matches(domain) || k.State(t) != KeyActive {
+			continue
+		}
+		if best == nil || (best.Domain == "*" && k.Domain != "*") ||
+			(best.Domain == "*") == (k.Domain == "*") && k.NotBefore.After(best.NotBefore) {
+			best = k
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("dkim: no active key for domain %q", domain)
+	}
+	return best, nil
+}
+
+// SignOptions returns signing options for a domain, using the active key.
+// The other options are copied from template, which may be nil. If the
+// template doesn't specify a clock, the keyring's is used.
+func (kr *Keyring) SignOptions(domain string, template *SignOptions) (*SignOptions, error) {
+	k, err := kr.Key(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var options SignOptions
+	if template != nil {
+		options = *template
+	}
+	options.Domain = domain
+	options.Selector = k.Selector
+	options.Signer = k.Signer
+	options.DigestSigner = k.DigestSigner
+	if options.Now == nil {
+		options.Now = kr.Now
+	}
+	return &options, nil
+}
+
+func (k *KeyringKey) matches(domain string) bool {
+	return k.Domain == "*" || strings.EqualFold(k.Domain, domain)
+}
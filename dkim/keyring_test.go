@@ -0,0 +1,128 @@
+package dkim
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyring(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	t1 := time.Unix(2000, 0)
+	t2 := time.Unix(3000, 0)
+
+	var current time.Time
+	kr := Keyring{Now: func() time.Time { return current }}
+
+	old := &KeyringKey{Domain: "example.org", Selector: "old", Signer: testPrivateKey, NotAfter: t1}
+	cur := &KeyringKey{Domain: "example.org", Selector: "cur", Signer: testPrivateKey, NotBefore: t0}
+	next := &KeyringKey{Domain: "example.org", Selector: "next", Signer: testEd25519PrivateKey, NotBefore: t2}
+	fallback := &KeyringKey{Domain: "*", Selector: "fallback", Signer: testPrivateKey}
+	for _, k := range []*KeyringKey{old, cur, next, fallback} {
+		if err := kr.Add(k); err != nil {
+			t.Fatalf("Expected no error while adding key %q, got %v", k.Selector, err)
+		}
+	}
+
+	tests := []struct {
+		now     time.Time
+		key     *KeyringKey
+		retired []*KeyringKey
+	}{
+		{time.Unix(500, 0), old, nil},
+		{time.Unix(1500, 0), cur, nil},
+		{t1, cur, []*KeyringKey{old}},
+		{t2, next, []*KeyringKey{old}},
+	}
+	for _, test := range tests {
+		current = test.now
+
+		k, err := kr.Key("EXAMPLE.ORG")
+		if err != nil {
+			t.Fatalf("Expected no error at %v, got %v", test.now, err)
+		}
+		if k != test.key {
+			t.Errorf("Expected key %q at %v, got %q", test.key.Selector, test.now, k.Selector)
+		}
+
+		if retired := kr.Retired("example.org"); !reflect.DeepEqual(retired, test.retired) {
+			t.Errorf("Expected retired keys %v at %v, got %v", test.retired, test.now, retired)
+		}
+	}
+
+	if k, err := kr.Key("example.com"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	} else if k != fallback {
+		t.Errorf("Expected wildcard key, got %q", k.Selector)
+	}
+
+	if keys := kr.Keys("example.org"); len(keys) != 4 {
+		t.Errorf("Expected 4 keys including retired ones, got %v", len(keys))
+	}
+}
+
+func TestKeyring_signOptions(t *testing.T) {
+	kr := Keyring{Now: func() time.Time { return time.Unix(424242, 0) }}
+	err := kr.Add(&KeyringKey{
+		Domain:    "example.org",
+		Selector:  "brisbane",
+		Signer:    testPrivateKey,
+		NotBefore: time.Unix(400000, 0),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error while adding key, got %v", err)
+	}
+
+	options, err := kr.SignOptions("example.org", nil)
+	if err != nil {
+		t.Fatalf("Expected no error while getting sign options, got %v", err)
+	}
+
+	r := strings.NewReader(mailString)
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	if s := b.String(); s != signedMailString {
+		t.Errorf("Expected signed message to be \n%v\n but got \n%v", signedMailString, s)
+	}
+}
+
+func TestKeyring_noActiveKey(t *testing.T) {
+	kr := Keyring{Now: func() time.Time { return time.Unix(100, 0) }}
+	err := kr.Add(&KeyringKey{
+		Domain:    "example.org",
+		Selector:  "brisbane",
+		Signer:    testPrivateKey,
+		NotBefore: time.Unix(200, 0),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error while adding key, got %v", err)
+	}
+
+	if _, err := kr.Key("example.org"); err == nil {
+		t.Error("Expected an error when no key is active")
+	}
+}
+
+func TestKeyring_invalidKeys(t *testing.T) {
+	var kr Keyring
+	if err := kr.Add(&KeyringKey{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey}); err != nil {
+		t.Fatalf("Expected no error while adding key, got %v", err)
+	}
+
+	tests := []*KeyringKey{
+		{Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.org", Signer: testPrivateKey},
+		{Domain: "example.org", Selector: "sydney"},
+		{Domain: "Example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.org", Selector: "sydney", Signer: testPrivateKey, NotBefore: time.Unix(2, 0), NotAfter: time.Unix(1, 0)},
+	}
+	for _, k := range tests {
+		if err := kr.Add(k); err == nil {
+			t.Errorf("Expected an error while adding key %+v", k)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package dkim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MultiSigner generates several DKIM signatures in a single pass over the
+// message. The body is canonicalized and hashed once per distinct body
+// canonicalization and hash algorithm.
+//
+// MultiSigner follows the same contract as Signer: the whole message header
+// and body must be written to it, and Close must always be called. As with
+// Signer, no goroutine is involved.
+type MultiSigner struct {
+	configs   []*signConfig
+	hp        headerParser
+	hashers   bodyHasherSet // nil until the header has been parsed
+	bhs       []*bodyHasher
+	closed    bool
+	err       error
+	sigParams []map[string]string // only valid after a successful Close
+}
+
+var errMultiSignerClosed = errors.New("dkim: write on closed MultiSigner")
+
+// NewMultiSigner creates a new signer producing one signature per element of
+// options. It returns an error if any SignOptions is invalid.
+func NewMultiSigner(options []*SignOptions) (*MultiSigner, error) {
+	if len(options) == 0 {
+		return nil, fmt.Errorf("dkim: no options specified")
+	}
+
+	configs := make([]*signConfig, len(options))
+	for i, opts := range options {
+		c, err := newSignConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		configs[i] = c
+	}
+
+	return &MultiSigner{configs: configs}, nil
+}
+
+// Write implements io.WriteCloser.
+func (s *MultiSigner) Write(b []byte) (n int, err error) {
+	if s.closed {
+		return 0, errMultiSignerClosed
+	} else if s.err != nil {
+		return 0, s.err
+	}
+
+	n = len(b)
+	if s.hashers == nil {
+		consumed := s.hp.parse(b)
+		if !s.hp.done {
+			return n, nil
+		}
+
+		// Hash body, once per distinct canonicalization and hash
+		s.hashers = make(bodyHasherSet)
+		s.bhs = make([]*bodyHasher, len(s.configs))
+		for i, c := range s.configs {
+			s.bhs[i] = s.hashers.get(bodyHashKey{c.bodyCan, c.hash, -1})
+		}
+		b = b[consumed:]
+	}
+
+	if _, err := s.hashers.Write(b); err != nil {
+		s.err = err
+		return 0, err
+	}
+	return n, nil
+}
+
+// Close implements io.WriteCloser. The error return by Close must be checked.
+func (s *MultiSigner) Close() error {
+	if s.closed {
+		return s.err
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.hashers == nil {
+		s.err = fmt.Errorf("failed to read header: %v", io.EOF)
+		return s.err
+	}
+	if err := s.hashers.Close(); err != nil {
+		s.err = err
+		return err
+	}
+
+	sigParams := make([]map[string]string, len(s.configs))
+	for i, c := range s.configs {
+		bh := s.bhs[i]
+		params, err := c.sign(s.hp.h, bh.Sum(), bh.Len())
+		if err != nil {
+			s.err = err
+			return err
+		}
+		sigParams[i] = params
+	}
+	s.sigParams = sigParams
+	return nil
+}
+
+// Signatures returns the DKIM-Signature header fields. It can only be called
+// after a successful MultiSigner.Close call.
+//
+// The fields are returned in the order they should be prepended to the
+// message, as if each signature had been prepended in turn: the field for the
+// last SignOptions comes first.
+func (s *MultiSigner) Signatures() []string {
+	if s.sigParams == nil {
+		panic("dkim: MultiSigner.Signatures must only be called after a succesful MultiSigner.Close")
+	}
+	sigs := make([]string, len(s.sigParams))
+	for i, params := range s.sigParams {
+		sigs[len(sigs)-1-i] = formatSignature(params)
+	}
+	return sigs
+}
+
+// SignMulti signs a message with several signatures. It reads it from r and
+// writes the signed version to w.
+func SignMulti(w io.Writer, r io.Reader, options []*SignOptions) error {
+	s, err := NewMultiSigner(options)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// We need to keep the message in a buffer so we can write the new DKIM
+	// header fields before the rest of the message
+	var b bytes.Buffer
+	mw := io.MultiWriter(&b, s)
+
+	if _, err := io.Copy(mw, r); err != nil {
+		return err
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	for _, sig := range s.Signatures() {
+		if _, err := io.WriteString(w, sig); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, &b)
+	return err
+}
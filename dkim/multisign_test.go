@@ -0,0 +1,125 @@
+package dkim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSignMulti(t *testing.T) {
+	options := []*SignOptions{
+		{
+			Domain:   "example.org",
+			Selector: "brisbane",
+			Signer:   testPrivateKey,
+		},
+		{
+			Domain:   "football.example.com",
+			Selector: "brisbane",
+			Signer:   testEd25519PrivateKey,
+		},
+		{
+			Domain:                 "football.example.com",
+			Selector:               "brisbane",
+			Signer:                 testEd25519PrivateKey,
+			HeaderCanonicalization: CanonicalizationRelaxed,
+			BodyCanonicalization:   CanonicalizationRelaxed,
+		},
+	}
+
+	var b bytes.Buffer
+	if err := SignMulti(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	// The signatures must be the same as the ones generated one at a time
+	var want string
+	for _, opts := range options {
+		s, err := NewSigner(opts)
+		if err != nil {
+			t.Fatal("Expected no error while creating signer, got:", err)
+		}
+		if _, err := s.Write([]byte(mailString)); err != nil {
+			t.Fatal("Expected no error while writing mail, got:", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal("Expected no error while signing mail, got:", err)
+		}
+		want = s.Signature() + want
+	}
+	want += mailString
+
+	if s := b.String(); s != want {
+		t.Errorf("Expected signed message to be \n%v\n but got \n%v", want, s)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signatures, got: %v", err)
+	}
+	if len(verifications) != len(options) {
+		t.Fatalf("Expected %v verifications, got %v", len(options), len(verifications))
+	}
+	for i, v := range verifications {
+		if v.Err != nil {
+			t.Errorf("Expected no error when verifying signature #%v, got: %v", i, v.Err)
+		}
+	}
+}
+
+func TestSignMulti_invalidOptions(t *testing.T) {
+	var b bytes.Buffer
+	if err := SignMulti(&b, strings.NewReader(mailString), nil); err == nil {
+		t.Error("Expected an error when signing a message without options")
+	}
+
+	options := []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.org", Signer: testPrivateKey},
+	}
+	if err := SignMulti(&b, strings.NewReader(mailString), options); err == nil {
+		t.Error("Expected an error when signing a message with invalid options")
+	}
+}
+
+func TestMultiSigner_smallWrites(t *testing.T) {
+	options := []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "football.example.com", Selector: "brisbane", Signer: testEd25519PrivateKey},
+	}
+
+	s, err := NewMultiSigner(options)
+	if err != nil {
+		t.Fatal("Expected no error while creating signer, got:", err)
+	}
+	for i := 0; i < len(mailString); i++ {
+		if _, err := s.Write([]byte{mailString[i]}); err != nil {
+			t.Fatal("Expected no error while writing mail, got:", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	if sigs := s.Signatures(); !strings.HasPrefix(signedMailString, sigs[1]) {
+		t.Errorf("Expected signature to be prefix of \n%v\n but got \n%v", signedMailString, sigs[1])
+	}
+	if _, err := s.Write([]byte(mailString)); err == nil {
+		t.Error("Expected an error when writing to a closed signer")
+	}
+}
+
+func TestMultiSigner_incompleteHeader(t *testing.T) {
+	s, err := NewMultiSigner([]*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+	})
+	if err != nil {
+		t.Fatal("Expected no error while creating signer, got:", err)
+	}
+	if _, err := s.Write([]byte("From: Joe SixPack")); err != nil {
+		t.Fatal("Expected no error while writing mail, got:", err)
+	}
+	if err := s.Close(); err == nil {
+		t.Error("Expected an error when closing a signer with an incomplete header")
+	}
+}
@@ -0,0 +1,79 @@
+//go:build cgo && dkim_openssl
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sschekotikhin/openssl"
+)
+
+// OpenSSLSigner is a crypto.Signer backed by an OpenSSL private key. It can be
+// used as SignOptions.Signer to have the DKIM signature computed by OpenSSL.
+//
+// Only RSA and Ed25519 keys are supported. Since OpenSSL hashes the signed
+// data itself, RSA keys can only sign DKIM signatures: calling Sign directly
+// on them returns an error.
+//
+// OpenSSLSigner requires cgo, and is only available when building with the
+// dkim_openssl build tag.
+type OpenSSLSigner struct {
+	key openssl.PrivateKey
+	pub crypto.PublicKey
+}
+
+// NewOpenSSLSigner creates a new signer from an OpenSSL private key.
+func NewOpenSSLSigner(key openssl.PrivateKey) (*OpenSSLSigner, error) {
+	der, err := key.MarshalPKIXPublicKeyDER()
+	if err != nil {
+		return nil, fmt.Errorf("dkim: failed to marshal OpenSSL public key: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: failed to parse OpenSSL public key: %v", err)
+	}
+
+	switch pub.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		// ok
+	default:
+		return nil, fmt.Errorf("dkim: unsupported key algorithm %T", pub)
+	}
+
+	return &OpenSSLSigner{key: key, pub: pub}, nil
+}
+
+// Public implements crypto.Signer.
+func (s *OpenSSLSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign implements crypto.Signer.
+func (s *OpenSSLSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := s.pub.(ed25519.PublicKey); !ok || opts.HashFunc() != 0 {
+		return nil, errors.New("dkim: OpenSSL signer can only sign Ed25519 messages")
+	}
+	return s.key.SignPKCS1v15(nil, digest)
+}
+
+func (s *OpenSSLSigner) signData(hash crypto.Hash, data []byte) ([]byte, error) {
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if hash != crypto.SHA256 {
+			return nil, fmt.Errorf("dkim: unsupported hash algorithm for OpenSSL signer")
+		}
+		return s.key.SignPKCS1v15(openssl.SHA256_Method, data)
+	case ed25519.PublicKey:
+		hasher := hash.New()
+		hasher.Write(data)
+		return s.key.SignPKCS1v15(nil, hasher.Sum(nil))
+	default:
+		panic("unreachable")
+	}
+}
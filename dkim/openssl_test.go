@@ -0,0 +1,54 @@
+//go:build cgo && dkim_openssl
+
+package dkim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sschekotikhin/openssl"
+)
+
+func newTestOpenSSLSigner(t *testing.T, keyPEM string) *OpenSSLSigner {
+	key, err := openssl.LoadPrivateKeyFromPEM([]byte(keyPEM))
+	if err != nil {
+		t.Fatalf("Failed to load OpenSSL private key: %v", err)
+	}
+	signer, err := NewOpenSSLSigner(key)
+	if err != nil {
+		t.Fatalf("Failed to create OpenSSL signer: %v", err)
+	}
+	return signer
+}
+
+func TestSign_openSSL(t *testing.T) {
+	tests := []struct {
+		name   string
+		keyPEM string
+		domain string
+		signed string
+	}{
+		{"rsa", testPrivateKeyPEM, "example.org", signedMailString},
+		{"ed25519", testEd25519PrivateKeyPEM, "football.example.com", signedEd25519MailString},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := &SignOptions{
+				Domain:   test.domain,
+				Selector: "brisbane",
+				Signer:   newTestOpenSSLSigner(t, test.keyPEM),
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+
+			if s := b.String(); s != test.signed {
+				t.Errorf("Expected signed message to be \n%v\n but got \n%v", test.signed, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package dkim
+
+import (
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"fmt"
+)
+
+var hashAlgos = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+}
+
+// RFC 8301 section 3.2: verifiers MUST NOT consider signatures using RSA keys
+// of less than 1024 bits as valid signatures.
+var defaultMinKeySizes = map[string]int{
+	KeyAlgoRSA: 1024,
+}
+
+// Policy controls which hash algorithms and key sizes are accepted when
+// verifying signatures.
+//
+// The zero value is the default policy, which follows RFC 8301: only the
+// sha256 hash algorithm is accepted, and RSA keys must be at least 1024 bits
+// long.
+type Policy struct {
+	// MinKeySizes maps key algorithms (e.g. "rsa") to the minimum key size in
+	// bits. Signatures made with a shorter key fail with ErrKeyTooShort. Key
+	// algorithms missing from the map use the default minimum. A minimum
+	// below 1024 bits for RSA doesn't comply with RFC 8301.
+	MinKeySizes map[string]int
+	// WeakKeySizes maps key algorithms to a key size in bits. Signatures made
+	// with a shorter key are accepted, but weak.
+	WeakKeySizes map[string]int
+
+	// HashAlgorithms lists the accepted hash algorithms (e.g. "sha256").
+	// Signatures using another hash algorithm fail with ErrWeakAlgorithm for
+	// sha1, or ErrUnsupportedAlgorithm. If nil, only sha256 is accepted.
+	HashAlgorithms []string
+	// WeakHashAlgorithms lists hash algorithms which are accepted, but weak.
+	// For instance, "sha1" allows old rsa-sha1 signatures to be verified.
+	WeakHashAlgorithms []string
+}
+
+var defaultPolicy Policy
+
+// hash returns the hash function for a hash algorithm name, and whether the
+// policy considers it weak.
+func (p *Policy) hash(name string) (crypto.Hash, bool, error) {
+	h, ok := hashAlgos[name]
+	if !ok {
+		return 0, false, permFailError(ErrUnsupportedAlgorithm, name)
+	}
+	if hasTagValue(p.WeakHashAlgorithms, name) {
+		return h, true, nil
+	}
+
+	accepted := p.HashAlgorithms
+	if accepted == nil {
+		accepted = []string{"sha256"}
+	}
+	if !hasTagValue(accepted, name) {
+		if h == crypto.SHA1 {
+			// RFC 8301 section 3.1: rsa-sha1 MUST NOT be used for signing or
+			// verifying.
+			return 0, false, permFailError(ErrWeakAlgorithm, name)
+		}
+		return 0, false, permFailError(ErrUnsupportedAlgorithm, name+" not allowed by policy")
+	}
+	return h, false, nil
+}
+
+// checkKeySize checks the size in bits of a key, and returns whether the
+// policy considers it weak.
+func (p *Policy) checkKeySize(keyAlgo string, size int) (bool, error) {
+	min, ok := p.MinKeySizes[keyAlgo]
+	if !ok {
+		min = defaultMinKeySizes[keyAlgo]
+	}
+	if size < min {
+		return false, permFailError(ErrKeyTooShort, fmt.Sprintf("want %v bits, has %v bits", min, size))
+	}
+	return size < p.WeakKeySizes[keyAlgo], nil
+}
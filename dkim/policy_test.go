@@ -0,0 +1,78 @@
+package dkim
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// signSHA1 signs mailString with rsa-sha1, which Sign refuses to do.
+func signSHA1(tb testing.TB) string {
+	c := &signConfig{
+		options:   &SignOptions{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		keyAlgo:   KeyAlgoRSA,
+		hash:      crypto.SHA1,
+		hashAlgo:  "sha1",
+		headerCan: CanonicalizationSimple,
+		bodyCan:   CanonicalizationSimple,
+	}
+
+	var p headerParser
+	n := p.parse([]byte(mailString))
+	bh := c.newBodyHasher()
+	if _, err := io.WriteString(bh, mailString[n:]); err != nil {
+		tb.Fatal("Expected no error while hashing body, got:", err)
+	}
+	if err := bh.Close(); err != nil {
+		tb.Fatal("Expected no error while hashing body, got:", err)
+	}
+
+	params, err := c.sign(p.h, bh.Sum(), bh.Len())
+	if err != nil {
+		tb.Fatal("Expected no error while signing mail, got:", err)
+	}
+	return formatSignature(params) + mailString
+}
+
+func TestPolicy(t *testing.T) {
+	sha1Signed := signSHA1(t)
+
+	tests := []struct {
+		name   string
+		signed string
+		policy *Policy
+		reason FailureReason
+		weak   bool
+	}{
+		{"default", signedMailString, nil, "", false},
+		{"min-key-size", signedMailString, &Policy{MinKeySizes: map[string]int{"rsa": 2048}}, ErrKeyTooShort, false},
+		{"weak-key-size", signedMailString, &Policy{WeakKeySizes: map[string]int{"rsa": 2048}}, "", true},
+		{"other-key-algo", signedEd25519MailString, &Policy{MinKeySizes: map[string]int{"rsa": 2048}}, "", false},
+		{"sha1-default", sha1Signed, nil, ErrWeakAlgorithm, false},
+		{"sha1-weak", sha1Signed, &Policy{WeakHashAlgorithms: []string{"sha1"}}, "", true},
+		{"sha1-allowed", sha1Signed, &Policy{HashAlgorithms: []string{"sha1", "sha256"}}, "", false},
+		{"sha256-denied", signedMailString, &Policy{HashAlgorithms: []string{"sha1"}}, ErrUnsupportedAlgorithm, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifications, err := VerifyWithOptions(strings.NewReader(test.signed), &VerifyOptions{Policy: test.policy})
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+
+			v := verifications[0]
+			if test.reason == "" && v.Err != nil {
+				t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+			} else if test.reason != "" && !errors.Is(v.Err, test.reason) {
+				t.Errorf("Expected reason %q, got: %v", test.reason, v.Err)
+			}
+			if v.Weak != test.weak {
+				t.Errorf("Expected weak to be %v, got %v", test.weak, v.Weak)
+			}
+		})
+	}
+}
@@ -1,13 +1,17 @@
 package dkim
 
 import (
+	"context"
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
 type verifier interface {
@@ -27,9 +31,25 @@ func (v rsaVerifier) Verify(hash crypto.Hash, hashed, sig []byte) error {
 	return rsa.VerifyPKCS1v15(v.PublicKey, hash, hashed, sig)
 }
 
+type ed25519Verifier struct {
+	ed25519.PublicKey
+}
+
+func (v ed25519Verifier) Public() crypto.PublicKey {
+	return v.PublicKey
+}
+
+func (v ed25519Verifier) Verify(hash crypto.Hash, hashed, sig []byte) error {
+	if !ed25519.Verify(v.PublicKey, hashed, sig) {
+		return errors.New("dkim: invalid Ed25519 signature")
+	}
+	return nil
+}
+
 type queryResult struct {
 	Verifier  verifier
 	KeyAlgo   string
+	KeySize   int
 	HashAlgos []string
 	Notes     string
 	Services  []string
@@ -44,57 +64,78 @@ const (
 	QueryMethodDNSTXT QueryMethod = "dns/txt"
 )
 
-type txtLookupFunc func(domain string) ([]string, error)
-type queryFunc func(domain, selector string, txtLookup txtLookupFunc) (*queryResult, error)
+// Resolver looks up DNS TXT records. It's implemented by *net.Resolver.
+//
+// This is the same interface as dmarc.Resolver, so that a single resolver can
+// be used for both DKIM and DMARC.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// TTLResolver is a Resolver which can also report the TTL of records. If the
+// resolver used by a KeyCache implements TTLResolver, record TTLs are used
+// instead of KeyCache.TTL.
+type TTLResolver interface {
+	Resolver
+	// LookupTXTWithTTL returns the DNS TXT records for the given domain name,
+	// along with their TTL. If the TTL is unknown, zero is returned.
+	LookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error)
+}
+
+type txtLookupFunc func(ctx context.Context, domain string) ([]string, time.Duration, error)
+type queryFunc func(ctx context.Context, domain, selector string, txtLookup txtLookupFunc) (*queryResult, time.Duration, error)
 
 var queryMethods = map[QueryMethod]queryFunc{
 	QueryMethodDNSTXT: queryDNSTXT,
 }
 
-func queryDNSTXT(domain, selector string, txtLookup txtLookupFunc) (*queryResult, error) {
+func queryDNSTXT(ctx context.Context, domain, selector string, txtLookup txtLookupFunc) (*queryResult, time.Duration, error) {
 	var txts []string
+	var ttl time.Duration
 	var err error
 	if txtLookup != nil {
-		txts, err = txtLookup(selector + "._domainkey." + domain)
+		txts, ttl, err = txtLookup(ctx, selector+"._domainkey."+domain)
 	} else {
-		txts, err = net.LookupTXT(selector + "._domainkey." + domain)
+		txts, err = net.DefaultResolver.LookupTXT(ctx, selector+"._domainkey."+domain)
 	}
 
-	if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-		return nil, tempFailError("key unavailable: " + err.Error())
+	// Lookups interrupted by ctx are temporary failures
+	if netErr, ok := err.(net.Error); (ok && netErr.Temporary()) || (err != nil && ctx.Err() != nil) {
+		return nil, 0, tempFailError(ErrKeyUnavailable, err.Error())
 	} else if err != nil {
-		return nil, permFailError("no key for signature: " + err.Error())
+		return nil, 0, permFailError(ErrNoKey, err.Error())
 	}
 
 	// Long keys are split in multiple parts
 	txt := strings.Join(txts, "")
 
-	return parsePublicKey(txt)
+	res, err := parsePublicKey(txt)
+	return res, ttl, err
 }
 
 func parsePublicKey(s string) (*queryResult, error) {
 	params, err := parseHeaderParams(s)
 	if err != nil {
-		return nil, permFailError("key syntax error: " + err.Error())
+		return nil, permFailError(ErrKeySyntax, err.Error())
 	}
 
 	res := new(queryResult)
 
 	if v, ok := params["v"]; ok && v != "DKIM1" {
-		return nil, permFailError("incompatible public key version")
+		return nil, permFailError(ErrKeySyntax, "incompatible public key version")
 	}
 
 	p, ok := params["p"]
 	if !ok {
-		return nil, permFailError("key syntax error: missing public key data")
+		return nil, permFailError(ErrKeySyntax, "missing public key data")
 	}
 	if p == "" {
-		return nil, permFailError("key revoked")
+		return nil, permFailError(ErrKeyRevoked, "")
 	}
 	p = strings.ReplaceAll(p, " ", "")
 	b, err := base64.StdEncoding.DecodeString(p)
 	if err != nil {
-		return nil, permFailError("key syntax error: " + err.Error())
+		return nil, permFailError(ErrKeySyntax, err.Error())
 	}
 	switch params["k"] {
 	case "rsa", "":
@@ -106,22 +147,27 @@ func parsePublicKey(s string) (*queryResult, error) {
 			// allowing both.
 			pub, err = x509.ParsePKCS1PublicKey(b)
 			if err != nil {
-				return nil, permFailError("key syntax error: " + err.Error())
+				return nil, permFailError(ErrKeySyntax, err.Error())
 			}
 		}
 		rsaPub, ok := pub.(*rsa.PublicKey)
 		if !ok {
-			return nil, permFailError("key syntax error: not an RSA public key")
-		}
-		// RFC 8301 section 3.2: verifiers MUST NOT consider signatures using
-		// RSA keys of less than 1024 bits as valid signatures.
-		if rsaPub.Size()*8 < 1024 {
-			return nil, permFailError(fmt.Sprintf("key is too short: want 1024 bits, has %v bits", rsaPub.Size()*8))
+			return nil, permFailError(ErrKeySyntax, "not an RSA public key")
 		}
 		res.Verifier = rsaVerifier{rsaPub}
 		res.KeyAlgo = "rsa"
+		res.KeySize = rsaPub.Size() * 8
+	case "ed25519":
+		// RFC 8463 section 4.2: the public key is the raw 32-byte Ed25519
+		// public key.
+		if len(b) != ed25519.PublicKeySize {
+			return nil, permFailError(ErrKeySyntax, fmt.Sprintf("invalid Ed25519 public key size: %v bytes", len(b)))
+		}
+		res.Verifier = ed25519Verifier{ed25519.PublicKey(b)}
+		res.KeyAlgo = "ed25519"
+		res.KeySize = 256
 	default:
-		return nil, permFailError("unsupported key algorithm")
+		return nil, permFailError(ErrInappropriateKeyAlgorithm, "unsupported key algorithm")
 	}
 
 	if hashesStr, ok := params["h"]; ok {
@@ -1,7 +1,12 @@
 package dkim
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"testing"
+	"time"
 )
 
 const dnsRawRSAPublicKey = "v=DKIM1; p=MIGJAoGBALVI635dLK4cJJAH3Lx6upo3X/L" +
@@ -16,17 +21,51 @@ const dnsPublicKey = "v=DKIM1; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQ" +
 	"/RtdC2UzJ1lWT947qR+Rcac2gbto/NMqJ0fzfVjH4OuKhi" +
 	"tdY9tf6mcwGjaNBcWToIMmPSPDdQPNUYckcQ2QIDAQAB"
 
+const dnsEd25519PublicKey = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+
 func init() {
 	queryMethods["dns/txt"] = queryTest
 }
 
-func queryTest(domain, selector string, txtLookup txtLookupFunc) (*queryResult, error) {
-	record := selector + "._domainkey." + domain
+func queryTest(ctx context.Context, domain, selector string, txtLookup txtLookupFunc) (*queryResult, time.Duration, error) {
+	res, err := parseTestPublicKey(selector + "._domainkey." + domain)
+	return res, 0, err
+}
+
+func parseTestPublicKey(record string) (*queryResult, error) {
 	switch record {
 	case "brisbane._domainkey.example.com", "brisbane._domainkey.example.org", "test._domainkey.football.example.com":
 		return parsePublicKey(dnsPublicKey)
 	case "newengland._domainkey.example.com":
 		return parsePublicKey(dnsRawRSAPublicKey)
+	case "brisbane._domainkey.football.example.com":
+		return parsePublicKey(dnsEd25519PublicKey)
+	case "testing._domainkey.example.org":
+		return parsePublicKey(dnsPublicKey + "; t=y")
+	case "strict._domainkey.example.org":
+		return parsePublicKey(dnsPublicKey + "; t=s")
+	case "sha256._domainkey.example.com":
+		return parsePublicKey(dnsPublicKey + "; h=sha256")
+	case "service._domainkey.example.com":
+		return parsePublicKey(dnsPublicKey + "; s=other")
 	}
 	return nil, fmt.Errorf("unknown test DNS record %v", record)
 }
+
+type canceledResolver struct{}
+
+func (canceledResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	<-ctx.Done()
+	return nil, &net.DNSError{Err: ctx.Err().Error(), Name: name}
+}
+
+func TestQueryDNSTXT_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	txtLookup := (&VerifyOptions{Resolver: canceledResolver{}}).txtLookup()
+	_, _, err := queryDNSTXT(ctx, "example.org", "brisbane", txtLookup)
+	if !IsTempFail(err) || !errors.Is(err, ErrKeyUnavailable) {
+		t.Errorf("Expected a temporary failure, got: %v", err)
+	}
+}
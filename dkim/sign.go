@@ -1,28 +1,50 @@
 package dkim
 
 import (
-	"bufio"
 	"bytes"
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/sschekotikhin/openssl"
 )
 
 const (
-	KeyAlgo = "rsa"
+	KeyAlgoRSA     = "rsa"
+	KeyAlgoEd25519 = "ed25519"
+
+	// KeyAlgo is the key algorithm of RSA signing keys.
+	//
+	// Deprecated: use KeyAlgoRSA.
+	KeyAlgo = KeyAlgoRSA
 )
 
 var randReader io.Reader = rand.Reader
 
-// SignOptions is used to configure Sign. Domain, Selector and Signer are
-// mandatory.
+// DigestSigner signs DKIM signatures with a private key which isn't loaded in
+// memory, for instance because it's held by an HSM, a cloud KMS or a local
+// signing daemon.
+type DigestSigner interface {
+	// KeyAlgorithm returns the algorithm of the signing key, either
+	// KeyAlgoRSA or KeyAlgoEd25519.
+	KeyAlgorithm() string
+	// SignDigest signs the hash of the header data. algo is the DKIM signing
+	// algorithm (e.g. "rsa-sha256") and hash is the hash function used to
+	// compute hashed.
+	//
+	// RSA signatures must use PKCS #1 v1.5 padding. Ed25519 signatures must
+	// be computed over hashed, as specified in RFC 8463 section 3.
+	SignDigest(algo string, hash crypto.Hash, hashed []byte) ([]byte, error)
+}
+
+// SignOptions is used to configure Sign. Domain, Selector and one of Signer
+// or DigestSigner are mandatory.
 type SignOptions struct {
 	// The SDID claiming responsibility for an introduction of a message into the
 	// mail stream. Hence, the SDID value is used to form the query for the public
@@ -44,7 +66,12 @@ type SignOptions struct {
 	// The key used to sign the message.
 	//
 	// Supported Signer.Public() values are *rsa.PublicKey and
-	Signer openssl.PrivateKey
+	// ed25519.PublicKey. When built with the dkim_openssl tag, NewOpenSSLSigner
+	// can be used to sign with an OpenSSL-backed key.
+	Signer crypto.Signer
+	// An external signer used instead of Signer when the private key isn't
+	// available in memory.
+	DigestSigner DigestSigner
 	// The hash algorithm used to sign the message. If zero, a default hash will
 	// be chosen.
 	//
@@ -57,15 +84,46 @@ type SignOptions struct {
 	HeaderCanonicalization Canonicalization
 	BodyCanonicalization   Canonicalization
 
-	// A list of header fields to include in the signature. If nil, all headers
-	// will be included. If not nil, "From" MUST be in the list.
+	// A list of header fields to include in the signature. If nil, the header
+	// fields are selected with HeaderPresets. If not nil, "From" MUST be in
+	// the list.
 	//
 	// See RFC 6376 section 5.4.1 for recommended header fields.
 	HeaderKeys []string
+	// Named sets of header fields to include in the signature, used when
+	// HeaderKeys is nil. The header fields of the message which belong to any
+	// of these presets are signed. Trace and volatile header fields, such as
+	// Received or Authentication-Results, are never selected.
+	//
+	// If nil, HeaderPresetRecommended and HeaderPresetMIME are used.
+	HeaderPresets []HeaderPreset
+	// A list of header fields to oversign. Each of these header fields is
+	// included in the signature one more time than it appears in the
+	// message, so that the signature breaks if another instance is added.
+	//
+	// See RFC 6376 section 8.15.
+	OversignHeaderKeys []string
+
+	// If true, a copy of the signed header fields is included in the
+	// signature ("z=" tag). This helps diagnosing signature failures caused
+	// by header fields altered in transit.
+	CopyHeaderFields bool
+
+	// If true, the length of the canonicalized body is included in the
+	// signature ("l=" tag).
+	//
+	// This is insecure: it allows content to be appended to the body without
+	// breaking the signature. See RFC 6376 section 8.2.
+	BodyLength bool
 
-	// The expiration time. A zero value means no expiration.
+	// The expiration time. A zero value means no expiration. It must be
+	// later than the signature time.
 	Expiration time.Time
 
+	// Now returns the current time, used as the signature time ("t=" tag). If
+	// nil, time.Now is used.
+	Now func() time.Time
+
 	// A list of query methods used to retrieve the public key.
 	//
 	// If nil, it is implicitly defined as QueryMethodDNSTXT.
@@ -81,15 +139,31 @@ type SignOptions struct {
 //
 // After a successful Close, Signature can be called to retrieve the
 // DKIM-Signature header field that the caller should prepend to the message.
+//
+// The header is parsed and the body is hashed as they are written: no
+// goroutine is involved.
 type Signer struct {
-	pw        *io.PipeWriter
-	done      <-chan error
-	sigParams map[string]string // only valid after done received nil
+	c         *signConfig
+	hp        headerParser
+	bh        *bodyHasher // nil until the header has been parsed
+	closed    bool
+	err       error
+	sigParams map[string]string // only valid after a successful Close
 }
 
-// NewSigner creates a new signer. It returns an error if SignOptions is
-// invalid.
-func NewSigner(options *SignOptions) (*Signer, error) {
+var errSignerClosed = errors.New("dkim: write on closed Signer")
+
+// signConfig holds validated signing options.
+type signConfig struct {
+	options   *SignOptions
+	keyAlgo   string
+	hash      crypto.Hash
+	hashAlgo  string
+	headerCan Canonicalization
+	bodyCan   Canonicalization
+}
+
+func newSignConfig(options *SignOptions) (*signConfig, error) {
 	if options == nil {
 		return nil, fmt.Errorf("dkim: no options specified")
 	}
@@ -99,15 +173,35 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 	if options.Selector == "" {
 		return nil, fmt.Errorf("dkim: no selector specified")
 	}
-	if options.Signer == nil {
+	if options.Signer == nil && options.DigestSigner == nil {
 		return nil, fmt.Errorf("dkim: no signer specified")
 	}
+	if options.Signer != nil && options.DigestSigner != nil {
+		return nil, fmt.Errorf("dkim: both signer and digest signer specified")
+	}
+
+	var keyAlgo string
+	if options.DigestSigner != nil {
+		keyAlgo = options.DigestSigner.KeyAlgorithm()
+		if keyAlgo != KeyAlgoRSA && keyAlgo != KeyAlgoEd25519 {
+			return nil, fmt.Errorf("dkim: unsupported key algorithm %q", keyAlgo)
+		}
+	} else {
+		switch options.Signer.Public().(type) {
+		case *rsa.PublicKey:
+			keyAlgo = KeyAlgoRSA
+		case ed25519.PublicKey:
+			keyAlgo = KeyAlgoEd25519
+		default:
+			return nil, fmt.Errorf("dkim: unsupported key algorithm %T", options.Signer.Public())
+		}
+	}
 
 	headerCan := options.HeaderCanonicalization
 	if headerCan == "" {
 		headerCan = CanonicalizationSimple
 	}
-	if _, ok := canonicalizers[headerCan]; !ok {
+	if LookupCanonicalizer(headerCan) == nil {
 		return nil, fmt.Errorf("dkim: unknown header canonicalization %q", headerCan)
 	}
 
@@ -115,7 +209,7 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 	if bodyCan == "" {
 		bodyCan = CanonicalizationSimple
 	}
-	if _, ok := canonicalizers[bodyCan]; !ok {
+	if LookupCanonicalizer(bodyCan) == nil {
 		return nil, fmt.Errorf("dkim: unknown body canonicalization %q", bodyCan)
 	}
 
@@ -133,150 +227,208 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 		return nil, fmt.Errorf("dkim: unsupported hash algorithm")
 	}
 
-	if options.HeaderKeys != nil {
-		ok := false
-		for _, k := range options.HeaderKeys {
-			if strings.EqualFold(k, "From") {
-				ok = true
-				break
-			}
+	for _, p := range options.HeaderPresets {
+		if _, ok := headerPresets[p]; !ok {
+			return nil, fmt.Errorf("dkim: unknown header preset %q", p)
 		}
-		if !ok {
+	}
+
+	if options.HeaderKeys != nil {
+		if !hasHeaderKey(options.HeaderKeys, "From") && !hasHeaderKey(options.OversignHeaderKeys, "From") {
 			return nil, fmt.Errorf("dkim: the From header field must be signed")
 		}
 	}
 
-	done := make(chan error, 1)
-	pr, pw := io.Pipe()
+	return &signConfig{
+		options:   options,
+		keyAlgo:   keyAlgo,
+		hash:      hash,
+		hashAlgo:  hashAlgo,
+		headerCan: headerCan,
+		bodyCan:   bodyCan,
+	}, nil
+}
 
-	s := &Signer{
-		pw:   pw,
-		done: done,
-	}
+func (c *signConfig) newBodyHasher() *bodyHasher {
+	return newBodyHasher(c.bodyCan, c.hash, -1)
+}
+
+// sign computes the DKIM-Signature tags for the message header h and the
+// canonicalized body hash bodyHashed. bodyLen is the length of the
+// canonicalized body.
+func (c *signConfig) sign(h header, bodyHashed []byte, bodyLen int64) (map[string]string, error) {
+	options := c.options
 
-	closeReadWithError := func(err error) {
-		pr.CloseWithError(err)
-		done <- err
+	t := now()
+	if options.Now != nil {
+		t = options.Now()
+	}
+	if !options.Expiration.IsZero() && options.Expiration.Unix() <= t.Unix() {
+		return nil, fmt.Errorf("dkim: expiration time is not after signature time")
 	}
 
-	go func() {
-		defer close(done)
+	params := map[string]string{
+		"v":  "1",
+		"a":  c.keyAlgo + "-" + c.hashAlgo,
+		"bh": base64.StdEncoding.EncodeToString(bodyHashed),
+		"c":  string(c.headerCan) + "/" + string(c.bodyCan),
+		"d":  options.Domain,
+		"s":  options.Selector,
+		"t":  formatTime(t),
+	}
 
-		// Read header
-		br := bufio.NewReader(pr)
-		h, err := readHeader(br)
-		if err != nil {
-			closeReadWithError(err)
-			return
-		}
+	var headerKeys []string
+	if options.HeaderKeys != nil {
+		headerKeys = options.HeaderKeys
+	} else {
+		headerKeys = selectHeaderKeys(h, options.HeaderPresets)
+	}
+	headerKeys = oversignHeaderKeys(h, headerKeys, options.OversignHeaderKeys)
+	params["h"] = formatTagList(headerKeys)
 
-		// Hash body
-		hasher := hash.New()
-		can := canonicalizers[bodyCan].CanonicalizeBody(hasher)
-		if _, err := io.Copy(can, br); err != nil {
-			closeReadWithError(err)
-			return
-		}
-		if err := can.Close(); err != nil {
-			closeReadWithError(err)
-			return
-		}
-		bodyHashed := hasher.Sum(nil)
-
-		params := map[string]string{
-			"v":  "1",
-			"a":  KeyAlgo + "-" + hashAlgo,
-			"bh": base64.StdEncoding.EncodeToString(bodyHashed),
-			"c":  string(headerCan) + "/" + string(bodyCan),
-			"d":  options.Domain,
-			//"l": "", // TODO
-			"s": options.Selector,
-			"t": formatTime(now()),
-			//"z": "", // TODO
-		}
+	if options.Identifier != "" {
+		params["i"] = options.Identifier
+	}
 
-		var headerKeys []string
-		if options.HeaderKeys != nil {
-			headerKeys = options.HeaderKeys
-		} else {
-			for _, kv := range h {
-				k, _ := parseHeaderField(kv)
-				headerKeys = append(headerKeys, k)
-			}
-		}
-		params["h"] = formatTagList(headerKeys)
+	if options.BodyLength {
+		params["l"] = strconv.FormatInt(bodyLen, 10)
+	}
 
-		if options.Identifier != "" {
-			params["i"] = options.Identifier
+	if options.QueryMethods != nil {
+		methods := make([]string, len(options.QueryMethods))
+		for i, method := range options.QueryMethods {
+			methods[i] = string(method)
 		}
+		params["q"] = formatTagList(methods)
+	}
 
-		if options.QueryMethods != nil {
-			methods := make([]string, len(options.QueryMethods))
-			for i, method := range options.QueryMethods {
-				methods[i] = string(method)
-			}
-			params["q"] = formatTagList(methods)
-		}
+	if !options.Expiration.IsZero() {
+		params["x"] = formatTime(options.Expiration)
+	}
 
-		if !options.Expiration.IsZero() {
-			params["x"] = formatTime(options.Expiration)
+	var signed header
+	picker := newHeaderPicker(h)
+	for _, k := range headerKeys {
+		kv := picker.Pick(k)
+		if kv == "" {
+			// The Signer MAY include more instances of a header field name
+			// in "h=" than there are actual corresponding header fields so
+			// that the signature will not verify if additional header
+			// fields of that name are added.
+			continue
 		}
+		signed = append(signed, kv)
+	}
 
-		// Hash and sign headers
-		buffer := &bytes.Buffer{}
-		picker := newHeaderPicker(h)
-		for _, k := range headerKeys {
-			kv := picker.Pick(k)
-			if kv == "" {
-				// The Signer MAY include more instances of a header field name
-				// in "h=" than there are actual corresponding header fields so
-				// that the signature will not verify if additional header
-				// fields of that name are added.
-				continue
-			}
+	if options.CopyHeaderFields && len(signed) > 0 {
+		params["z"] = formatCopiedHeaderFields(signed)
+	}
 
-			kv = canonicalizers[headerCan].CanonicalizeHeader(kv)
-			if _, err := io.WriteString(buffer, kv); err != nil {
-				closeReadWithError(err)
-				return
-			}
+	// Hash and sign headers
+	can := LookupCanonicalizer(c.headerCan)
+	buffer := &bytes.Buffer{}
+	for _, kv := range signed {
+		kv = can.CanonicalizeHeader(kv)
+		if _, err := io.WriteString(buffer, kv); err != nil {
+			return nil, err
 		}
+	}
 
-		params["b"] = ""
-		sigField := formatSignature(params)
-		sigField = canonicalizers[headerCan].CanonicalizeHeader(sigField)
-		sigField = strings.TrimRight(sigField, crlf)
-		if _, err := io.WriteString(buffer, sigField); err != nil {
-			closeReadWithError(err)
-			return
-		}
-		// hashed := hasher.Sum(nil)
+	params["b"] = ""
+	sigField := formatSignature(params)
+	sigField = can.CanonicalizeHeader(sigField)
+	sigField = strings.TrimRight(sigField, crlf)
+	if _, err := io.WriteString(buffer, sigField); err != nil {
+		return nil, err
+	}
 
-		sig, err := options.Signer.SignPKCS1v15(openssl.SHA256_Method, buffer.Bytes())
-		if err != nil {
-			closeReadWithError(err)
-			return
-		}
-		params["b"] = base64.StdEncoding.EncodeToString(sig)
+	sig, err := signData(options, params["a"], c.hash, buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	params["b"] = base64.StdEncoding.EncodeToString(sig)
 
-		s.sigParams = params
-		closeReadWithError(nil)
-	}()
+	return params, nil
+}
 
+// NewSigner creates a new signer. It returns an error if SignOptions is
+// invalid.
+func NewSigner(options *SignOptions) (*Signer, error) {
+	s := new(Signer)
+	if err := s.Reset(options); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+// Reset discards the Signer state and prepares it to sign a new message with
+// options. It returns an error if SignOptions is invalid, in which case Write
+// and Close return the same error until a successful Reset.
+//
+// Reset allows a Signer to be reused, for instance with a sync.Pool.
+func (s *Signer) Reset(options *SignOptions) error {
+	c, err := newSignConfig(options)
+
+	s.c = c
+	s.hp.reset()
+	s.bh = nil
+	s.closed = false
+	s.err = err
+	s.sigParams = nil
+	return err
+}
+
 // Write implements io.WriteCloser.
 func (s *Signer) Write(b []byte) (n int, err error) {
-	return s.pw.Write(b)
+	if s.closed {
+		return 0, errSignerClosed
+	} else if s.err != nil {
+		return 0, s.err
+	}
+
+	n = len(b)
+	if s.bh == nil {
+		consumed := s.hp.parse(b)
+		if !s.hp.done {
+			return n, nil
+		}
+		s.bh = s.c.newBodyHasher()
+		b = b[consumed:]
+	}
+
+	if _, err := s.bh.Write(b); err != nil {
+		s.err = err
+		return 0, err
+	}
+	return n, nil
 }
 
 // Close implements io.WriteCloser. The error return by Close must be checked.
 func (s *Signer) Close() error {
-	if err := s.pw.Close(); err != nil {
+	if s.closed {
+		return s.err
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.bh == nil {
+		s.err = fmt.Errorf("failed to read header: %v", io.EOF)
+		return s.err
+	}
+	if err := s.bh.Close(); err != nil {
+		s.err = err
 		return err
 	}
-	return <-s.done
+
+	params, err := s.c.sign(s.hp.h, s.bh.Sum(), s.bh.Len())
+	if err != nil {
+		s.err = err
+		return err
+	}
+	s.sigParams = params
+	return nil
 }
 
 // Signature returns the whole DKIM-Signature header field. It can only be
@@ -318,6 +470,67 @@ func Sign(w io.Writer, r io.Reader, options *SignOptions) error {
 	return err
 }
 
+// dataSigner is implemented by signers which hash the signed data
+// themselves, such as OpenSSL-backed keys.
+type dataSigner interface {
+	signData(hash crypto.Hash, data []byte) ([]byte, error)
+}
+
+func signData(options *SignOptions, algo string, hash crypto.Hash, data []byte) ([]byte, error) {
+	if ds, ok := options.Signer.(dataSigner); ok {
+		return ds.signData(hash, data)
+	}
+
+	hasher := hash.New()
+	hasher.Write(data)
+	hashed := hasher.Sum(nil)
+
+	if options.DigestSigner != nil {
+		return options.DigestSigner.SignDigest(algo, hash, hashed)
+	}
+
+	var opts crypto.SignerOpts = hash
+	if strings.HasPrefix(algo, KeyAlgoEd25519+"-") {
+		// RFC 8463 section 3: Ed25519 signs the hash of the header data
+		// rather than the data itself.
+		opts = crypto.Hash(0)
+	}
+	return options.Signer.Sign(randReader, hashed, opts)
+}
+
+// oversignHeaderKeys returns headerKeys with extra entries appended, so that
+// each header field name in oversign appears once more than its number of
+// instances in h.
+func oversignHeaderKeys(h header, headerKeys, oversign []string) []string {
+	if len(oversign) == 0 {
+		return headerKeys
+	}
+
+	keys := make([]string, len(headerKeys), len(headerKeys)+len(oversign))
+	copy(keys, headerKeys)
+	for _, name := range oversign {
+		instances := 0
+		for _, kv := range h {
+			k, _ := parseHeaderField(kv)
+			if strings.EqualFold(k, name) {
+				instances++
+			}
+		}
+
+		listed := 0
+		for _, k := range keys {
+			if strings.EqualFold(k, name) {
+				listed++
+			}
+		}
+
+		for ; listed <= instances; listed++ {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
 func formatSignature(params map[string]string) string {
 	sig := formatHeaderParams(headerFieldName, params)
 	return sig
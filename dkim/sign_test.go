@@ -3,9 +3,17 @@ package dkim
 import (
 	"bytes"
 	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const mailHeaderString = "From: Joe SixPack <joe@football.example.com>\r\n" +
@@ -54,6 +62,117 @@ func TestSign(t *testing.T) {
 	}
 }
 
+const signedEd25519MailString = "DKIM-Signature: a=ed25519-sha256; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;" + "\r\n" +
+	" " + "c=simple/simple; d=football.example.com;" + "\r\n" +
+	" " + "h=From:To:Subject:Date:Message-ID; s=brisbane; t=424242; v=1;" + "\r\n" +
+	" " + "b=k1LzRxs9/DfN/whlMICYKNIJhqUSmup0d5yw8tpi+Cfiqe6I3oSBmJ+HEp+moWy7/XvcUY/t" + "\r\n" +
+	" " + "ERHc3D2m7vw1AA==" + "\r\n" +
+	mailHeaderString +
+	"\r\n" +
+	mailBodyString
+
+func TestSignEd25519(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   testEd25519PrivateKey,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	if s := b.String(); s != signedEd25519MailString {
+		t.Errorf("Expected signed message to be \n%v\n but got \n%v", signedEd25519MailString, s)
+	}
+}
+
+// fakeDigestSigner is an in-process stand-in for an HSM or KMS.
+type fakeDigestSigner struct {
+	key   crypto.Signer
+	algos []string
+	err   error
+}
+
+func (s *fakeDigestSigner) KeyAlgorithm() string {
+	if _, ok := s.key.Public().(ed25519.PublicKey); ok {
+		return KeyAlgoEd25519
+	}
+	return KeyAlgoRSA
+}
+
+func (s *fakeDigestSigner) SignDigest(algo string, hash crypto.Hash, hashed []byte) ([]byte, error) {
+	s.algos = append(s.algos, algo)
+	if s.err != nil {
+		return nil, s.err
+	}
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(nil, key, hash, hashed)
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, hashed), nil
+	}
+	panic("unreachable")
+}
+
+func TestSign_digestSigner(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		domain string
+		algo   string
+		signed string
+	}{
+		{"rsa", testPrivateKey, "example.org", "rsa-sha256", signedMailString},
+		{"ed25519", testEd25519PrivateKey, "football.example.com", "ed25519-sha256", signedEd25519MailString},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ds := &fakeDigestSigner{key: test.key}
+			options := &SignOptions{
+				Domain:       test.domain,
+				Selector:     "brisbane",
+				DigestSigner: ds,
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+
+			if s := b.String(); s != test.signed {
+				t.Errorf("Expected signed message to be \n%v\n but got \n%v", test.signed, s)
+			}
+			if len(ds.algos) != 1 || ds.algos[0] != test.algo {
+				t.Errorf("Expected digest signer to be called once with %q, got %v", test.algo, ds.algos)
+			}
+		})
+	}
+}
+
+func TestSign_digestSignerError(t *testing.T) {
+	signErr := errors.New("HSM unavailable")
+	options := &SignOptions{
+		Domain:       "example.org",
+		Selector:     "brisbane",
+		DigestSigner: &fakeDigestSigner{key: testPrivateKey, err: signErr},
+	}
+
+	s, err := NewSigner(options)
+	if err != nil {
+		t.Fatalf("Expected no error while creating signer, got: %v", err)
+	}
+	if _, err := s.Write([]byte(mailString)); err != nil {
+		t.Fatalf("Expected no error while writing message, got: %v", err)
+	}
+	if err := s.Close(); err != signErr {
+		t.Errorf("Expected Close to return %v, got %v", signErr, err)
+	}
+}
+
 func TestSignAndVerify(t *testing.T) {
 	r := strings.NewReader(mailString)
 	options := &SignOptions{
@@ -84,6 +203,32 @@ func TestSignAndVerify(t *testing.T) {
 	}
 }
 
+func TestSignAndVerifyEd25519(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:                 "football.example.com",
+		Selector:               "brisbane",
+		Signer:                 testEd25519PrivateKey,
+		HeaderCanonicalization: "relaxed",
+		BodyCanonicalization:   "relaxed",
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	verifications, err := Verify(&b)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Error("Expected exactly one verification")
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+}
+
 func TestSignAndVerify_relaxed(t *testing.T) {
 	r := strings.NewReader(mailString)
 	options := &SignOptions{
@@ -108,6 +253,226 @@ func TestSignAndVerify_relaxed(t *testing.T) {
 	}
 }
 
+func TestSignAndVerify_bodyLength(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		BodyLength: true,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	bodyLen := int64(len(mailBodyString + "\r\n"))
+	if !strings.Contains(b.String(), fmt.Sprintf(" l=%v;", bodyLen)) {
+		t.Errorf("Expected signature to contain l=%v, got:\n%v", bodyLen, b.String())
+	}
+
+	const unsigned = "Unsigned.\r\n"
+	signed := b.String() + "\r\n" + unsigned
+
+	verifications, err := Verify(strings.NewReader(signed))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; !IsPolicyFail(err) || !errors.Is(err, ErrBodyLength) {
+		t.Errorf("Expected a policy failure when verifying a signature with a body length, got: %v", err)
+	}
+
+	options2 := &VerifyOptions{AllowBodyLength: true}
+	verifications, err = VerifyWithOptions(strings.NewReader(signed), options2)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	v := verifications[0]
+	if v.Err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+	}
+	if v.BodyLength != bodyLen {
+		t.Errorf("Expected body length to be %v, got %v", bodyLen, v.BodyLength)
+	}
+	if v.UnsignedBodyLength != int64(len(unsigned)) {
+		t.Errorf("Expected unsigned body length to be %v, got %v", len(unsigned), v.UnsignedBodyLength)
+	}
+}
+
+func TestSignAndVerify_copiedHeaderFields(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:           "example.org",
+		Selector:         "brisbane",
+		Signer:           testPrivateKey,
+		HeaderKeys:       []string{"From", "To", "Subject", "Subject"},
+		CopyHeaderFields: true,
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	if !strings.Contains(b.String(), " z=From:=20Joe=20SixPack") {
+		t.Errorf("Expected signature to contain copied header fields, got:\n%v", b.String())
+	}
+
+	verifications, err := Verify(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+
+	altered := strings.Replace(b.String(), "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1)
+	verifications, err = Verify(strings.NewReader(altered))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+	v := verifications[0]
+	if v.Err == nil {
+		t.Error("Expected an error when verifying an altered message")
+	}
+	if want := []string{"Subject"}; !reflect.DeepEqual(v.AlteredHeaderKeys, want) {
+		t.Errorf("Expected altered header keys to be %v, got %v", want, v.AlteredHeaderKeys)
+	}
+}
+
+func TestSignAndVerify_oversign(t *testing.T) {
+	r := strings.NewReader(mailString)
+	options := &SignOptions{
+		Domain:             "example.org",
+		Selector:           "brisbane",
+		Signer:             testPrivateKey,
+		HeaderKeys:         []string{"From", "To"},
+		OversignHeaderKeys: []string{"From", "Subject", "Reply-To"},
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, r, options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	if !strings.Contains(b.String(), " h=From:To:From:Subject:Subject:Reply-To;") {
+		t.Errorf("Expected oversigned header keys, got:\n%v", b.String())
+	}
+
+	verifications, err := Verify(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if err := verifications[0].Err; err != nil {
+		t.Errorf("Expected no error when verifying signature, got: %v", err)
+	}
+
+	added := "Subject: Free money\r\n" + b.String()
+	verifications, err = Verify(strings.NewReader(added))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	} else if verifications[0].Err == nil {
+		t.Error("Expected an error when verifying a message with an added Subject")
+	}
+}
+
+func TestSigner_smallWrites(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	s, err := NewSigner(options)
+	if err != nil {
+		t.Fatal("Expected no error while creating signer, got:", err)
+	}
+	for i := 0; i < len(mailString); i++ {
+		if _, err := s.Write([]byte{mailString[i]}); err != nil {
+			t.Fatal("Expected no error while writing mail, got:", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	if sig := s.Signature(); !strings.HasPrefix(signedMailString, sig) {
+		t.Errorf("Expected signature to be prefix of \n%v\n but got \n%v", signedMailString, sig)
+	}
+}
+
+func TestSigner_reset(t *testing.T) {
+	s, err := NewSigner(&SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	})
+	if err != nil {
+		t.Fatal("Expected no error while creating signer, got:", err)
+	}
+
+	// Abort a first message in the middle of the header
+	if _, err := s.Write([]byte("From: Joe SixPack")); err != nil {
+		t.Fatal("Expected no error while writing mail, got:", err)
+	}
+	if err := s.Close(); err == nil {
+		t.Error("Expected an error when closing a signer with an incomplete header")
+	}
+
+	err = s.Reset(&SignOptions{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   testEd25519PrivateKey,
+	})
+	if err != nil {
+		t.Fatal("Expected no error while resetting signer, got:", err)
+	}
+	if _, err := s.Write([]byte(mailString)); err != nil {
+		t.Fatal("Expected no error while writing mail, got:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+
+	if sig := s.Signature(); !strings.HasPrefix(signedEd25519MailString, sig) {
+		t.Errorf("Expected signature to be prefix of \n%v\n but got \n%v", signedEd25519MailString, sig)
+	}
+
+	if _, err := s.Write([]byte(mailString)); err == nil {
+		t.Error("Expected an error when writing to a closed signer")
+	}
+}
+
+func TestSigner_resetInvalidOptions(t *testing.T) {
+	s, err := NewSigner(&SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	})
+	if err != nil {
+		t.Fatal("Expected no error while creating signer, got:", err)
+	}
+
+	resetErr := s.Reset(&SignOptions{Domain: "example.org", Selector: "brisbane"})
+	if resetErr == nil {
+		t.Fatal("Expected an error when resetting signer with invalid options")
+	}
+	if _, err := s.Write([]byte(mailString)); err != resetErr {
+		t.Errorf("Expected the reset error while writing mail, got: %v", err)
+	}
+	if err := s.Close(); err != resetErr {
+		t.Errorf("Expected the reset error while closing signer, got: %v", err)
+	}
+}
+
 func TestSign_invalidOptions(t *testing.T) {
 	r := strings.NewReader(mailString)
 	var b bytes.Buffer
@@ -132,6 +497,12 @@ func TestSign_invalidOptions(t *testing.T) {
 	}
 	options.Signer = testPrivateKey
 
+	options.DigestSigner = &fakeDigestSigner{key: testPrivateKey}
+	if err := Sign(&b, r, options); err == nil {
+		t.Error("Expected an error when signing a message with both a signer and a digest signer")
+	}
+	options.DigestSigner = nil
+
 	options.HeaderCanonicalization = "pasta"
 	if err := Sign(&b, r, options); err == nil {
 		t.Error("Expected an error when signing a message with an invalid header canonicalization")
@@ -156,9 +527,92 @@ func TestSign_invalidOptions(t *testing.T) {
 	}
 	options.Hash = 0
 
+	options.HeaderPresets = []HeaderPreset{"pasta"}
+	if err := Sign(&b, r, options); err == nil {
+		t.Error("Expected an error when signing a message with an unknown header preset")
+	}
+	options.HeaderPresets = nil
+
 	options.HeaderKeys = []string{"To"}
 	if err := Sign(&b, r, options); err == nil {
 		t.Error("Expected an error when signing a message without the From header")
 	}
 	options.HeaderKeys = nil
 }
+
+func BenchmarkSigner(b *testing.B) {
+	options := &SignOptions{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   testEd25519PrivateKey,
+	}
+
+	bodies := map[string]string{
+		"small": mailBodyString,
+		"64KiB": strings.Repeat("We lost the game. Are you hungry yet?\r\n", 64*1024/39),
+	}
+
+	for name, body := range bodies {
+		msg := []byte(mailHeaderString + "\r\n" + body)
+
+		b.Run(name+"/sync", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg)))
+			for i := 0; i < b.N; i++ {
+				s, err := NewSigner(options)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := s.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if err := s.Close(); err != nil {
+					b.Fatal(err)
+				}
+				_ = s.Signature()
+			}
+		})
+
+		b.Run(name+"/pool", func(b *testing.B) {
+			pool := sync.Pool{New: func() interface{} { return new(Signer) }}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg)))
+			for i := 0; i < b.N; i++ {
+				s := pool.Get().(*Signer)
+				if err := s.Reset(options); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := s.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if err := s.Close(); err != nil {
+					b.Fatal(err)
+				}
+				_ = s.Signature()
+				pool.Put(s)
+			}
+		})
+	}
+}
+
+func TestSign_clock(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+		Now:      func() time.Time { return time.Unix(1000000, 0) },
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	if !strings.Contains(b.String(), " t=1000000;") {
+		t.Errorf("Expected signature time from the clock, got:\n%v", b.String())
+	}
+
+	options.Expiration = time.Unix(1000000, 0)
+	if err := Sign(io.Discard, strings.NewReader(mailString), options); err == nil {
+		t.Error("Expected an error when signing with an expiration time not after the signature time")
+	}
+}
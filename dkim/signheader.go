@@ -0,0 +1,116 @@
+package dkim
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BodyHash is the hash of a canonicalized message body.
+type BodyHash struct {
+	// The body canonicalization algorithm. If empty, CanonicalizationSimple
+	// is assumed.
+	Canonicalization Canonicalization
+	// The hash algorithm. If zero, crypto.SHA256 is assumed.
+	Hash crypto.Hash
+	// The hash of the canonicalized body.
+	Sum []byte
+	// The length of the canonicalized body. It's only used if
+	// SignOptions.BodyLength is set.
+	Length int64
+}
+
+// HashBody reads a message body from r, and canonicalizes and hashes it.
+func HashBody(r io.Reader, can Canonicalization, hash crypto.Hash) (*BodyHash, error) {
+	if can == "" {
+		can = CanonicalizationSimple
+	}
+	if LookupCanonicalizer(can) == nil {
+		return nil, fmt.Errorf("dkim: unknown body canonicalization %q", can)
+	}
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	if !hash.Available() {
+		return nil, fmt.Errorf("dkim: unsupported hash algorithm")
+	}
+
+	bh := newBodyHasher(can, hash, -1)
+	if _, err := io.Copy(bh, r); err != nil {
+		return nil, err
+	}
+	if err := bh.Close(); err != nil {
+		return nil, err
+	}
+
+	return &BodyHash{
+		Canonicalization: can,
+		Hash:             hash,
+		Sum:              bh.Sum(),
+		Length:           bh.Len(),
+	}, nil
+}
+
+// SignHeader generates a DKIM signature for a message whose body has already
+// been hashed. header contains the message header block, with one or several
+// CRLF-terminated header fields. Any data after the empty line terminating
+// the header block is ignored.
+//
+// The body canonicalization and hash algorithm of bh are used in place of
+// SignOptions.BodyCanonicalization and SignOptions.Hash.
+//
+// The returned value is the whole DKIM-Signature header field, as returned by
+// Signer.Signature.
+func SignHeader(header []byte, bh *BodyHash, options *SignOptions) (string, error) {
+	var p headerParser
+	p.parse(header)
+	if !p.done {
+		if len(p.buf) > 0 {
+			p.parse([]byte(crlf))
+		}
+		p.parse([]byte(crlf))
+	}
+	return signHeader(p.h, bh, options)
+}
+
+// SignHeaderFields is like SignHeader, but takes a list of header fields. Each
+// field contains the header field name and value, and may contain folding
+// whitespace. The final CRLF is optional.
+func SignHeaderFields(fields []string, bh *BodyHash, options *SignOptions) (string, error) {
+	h := make(header, len(fields))
+	for i, kv := range fields {
+		if !strings.HasSuffix(kv, crlf) {
+			kv += crlf
+		}
+		h[i] = kv
+	}
+	return signHeader(h, bh, options)
+}
+
+func signHeader(h header, bh *BodyHash, options *SignOptions) (string, error) {
+	if bh == nil {
+		return "", fmt.Errorf("dkim: no body hash specified")
+	}
+	if options == nil {
+		return "", fmt.Errorf("dkim: no options specified")
+	}
+
+	opts := *options
+	opts.BodyCanonicalization = bh.Canonicalization
+	opts.Hash = bh.Hash
+	c, err := newSignConfig(&opts)
+	if err != nil {
+		return "", err
+	}
+
+	if len(bh.Sum) != c.hash.Size() {
+		return "", fmt.Errorf("dkim: invalid body hash size")
+	}
+
+	params, err := c.sign(h, bh.Sum, bh.Length)
+	if err != nil {
+		return "", err
+	}
+	return formatSignature(params), nil
+}
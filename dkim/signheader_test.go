@@ -0,0 +1,69 @@
+package dkim
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignHeader(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	bh, err := HashBody(strings.NewReader(mailBodyString), CanonicalizationSimple, 0)
+	if err != nil {
+		t.Fatal("Expected no error while hashing body, got:", err)
+	}
+
+	want := strings.TrimSuffix(signedMailString, mailString)
+
+	sig, err := SignHeader([]byte(mailHeaderString+"\r\n"), bh, options)
+	if err != nil {
+		t.Fatal("Expected no error while signing header, got:", err)
+	}
+	if sig != want {
+		t.Errorf("Expected signature to be \n%v\n but got \n%v", want, sig)
+	}
+
+	// The final CRLF of the header block is optional
+	sig, err = SignHeader([]byte(strings.TrimSuffix(mailHeaderString, "\r\n")), bh, options)
+	if err != nil {
+		t.Fatal("Expected no error while signing header, got:", err)
+	}
+	if sig != want {
+		t.Errorf("Expected signature to be \n%v\n but got \n%v", want, sig)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(mailHeaderString, "\r\n"), "\r\n")
+	sig, err = SignHeaderFields(fields, bh, options)
+	if err != nil {
+		t.Fatal("Expected no error while signing header fields, got:", err)
+	}
+	if sig != want {
+		t.Errorf("Expected signature to be \n%v\n but got \n%v", want, sig)
+	}
+}
+
+func TestSignHeader_invalidBodyHash(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	if _, err := SignHeader([]byte(mailHeaderString), nil, options); err == nil {
+		t.Error("Expected an error when signing without a body hash")
+	}
+
+	bh := &BodyHash{Sum: []byte("too short")}
+	if _, err := SignHeader([]byte(mailHeaderString), bh, options); err == nil {
+		t.Error("Expected an error when signing with an invalid body hash")
+	}
+
+	bh = &BodyHash{Canonicalization: "potatoe", Sum: make([]byte, 32)}
+	if _, err := SignHeader([]byte(mailHeaderString), bh, options); err == nil {
+		t.Error("Expected an error when signing with an invalid body canonicalization")
+	}
+}
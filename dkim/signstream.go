@@ -0,0 +1,145 @@
+package dkim
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// SignSeeker signs a message without keeping it in memory. It reads it from r
+// a first time to compute the signature, then seeks back to the initial
+// offset and copies it to w after the DKIM-Signature header field.
+//
+// The output is the same as Sign's.
+func SignSeeker(w io.Writer, r io.ReadSeeker, options *SignOptions) error {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signMessage(r, options)
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, sig); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// SignReaderAt signs a message of size bytes without keeping it in memory. It
+// reads it from r twice: a first time to compute the signature, and a second
+// time to copy it to w after the DKIM-Signature header field.
+//
+// The output is the same as Sign's.
+func SignReaderAt(w io.Writer, r io.ReaderAt, size int64, options *SignOptions) error {
+	return SignSeeker(w, io.NewSectionReader(r, 0, size), options)
+}
+
+// SignSpill signs a message. It reads it from r and writes the signed version
+// to w. Messages larger than maxMemory bytes are spilled to a temporary file
+// instead of being kept in memory.
+//
+// The output is the same as Sign's.
+func SignSpill(w io.Writer, r io.Reader, options *SignOptions, maxMemory int64) error {
+	s, err := NewSigner(options)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	b := &spillBuffer{max: maxMemory}
+	defer b.Close()
+
+	mw := io.MultiWriter(b, s)
+	if _, err := io.Copy(mw, r); err != nil {
+		return err
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	br, err := b.Reader()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, s.Signature()); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
+
+// signMessage reads a message from r and returns its DKIM-Signature header
+// field.
+func signMessage(r io.Reader, options *SignOptions) (string, error) {
+	s, err := NewSigner(options)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	if _, err := io.Copy(s, r); err != nil {
+		return "", err
+	}
+	if err := s.Close(); err != nil {
+		return "", err
+	}
+	return s.Signature(), nil
+}
+
+// spillBuffer is a buffer which moves its contents to a temporary file when
+// it grows larger than max bytes.
+type spillBuffer struct {
+	max int64
+	buf bytes.Buffer
+	f   *os.File
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.f == nil && int64(b.buf.Len()+len(p)) > b.max {
+		f, err := os.CreateTemp("", "dkim-*")
+		if err != nil {
+			return 0, err
+		}
+		b.f = f
+		if _, err := b.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.f != nil {
+		return b.f.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Reader returns a reader for the buffer contents. Write must not be called
+// afterwards.
+func (b *spillBuffer) Reader() (io.Reader, error) {
+	if b.f == nil {
+		return &b.buf, nil
+	}
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.f, nil
+}
+
+// Close removes the temporary file, if any.
+func (b *spillBuffer) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	if rmErr := os.Remove(b.f.Name()); err == nil {
+		err = rmErr
+	}
+	b.f = nil
+	return err
+}
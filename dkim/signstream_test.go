@@ -0,0 +1,49 @@
+package dkim
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSign_streaming(t *testing.T) {
+	options := &SignOptions{
+		Domain:   "example.org",
+		Selector: "brisbane",
+		Signer:   testPrivateKey,
+	}
+
+	tests := []struct {
+		name string
+		sign func(b *bytes.Buffer) error
+	}{
+		{"SignSeeker", func(b *bytes.Buffer) error {
+			r := strings.NewReader("garbage" + mailString)
+			r.Seek(int64(len("garbage")), io.SeekStart)
+			return SignSeeker(b, r, options)
+		}},
+		{"SignReaderAt", func(b *bytes.Buffer) error {
+			r := strings.NewReader(mailString)
+			return SignReaderAt(b, r, r.Size(), options)
+		}},
+		{"SignSpill/memory", func(b *bytes.Buffer) error {
+			return SignSpill(b, strings.NewReader(mailString), options, 1<<20)
+		}},
+		{"SignSpill/file", func(b *bytes.Buffer) error {
+			return SignSpill(b, strings.NewReader(mailString), options, 16)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := test.sign(&b); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+			if s := b.String(); s != signedMailString {
+				t.Errorf("Expected signed message to be \n%v\n but got \n%v", signedMailString, s)
+			}
+		})
+	}
+}
@@ -1,86 +1,111 @@
 package dkim
 
 import (
-	"bufio"
+	"context"
 	"crypto"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
 
-type permFailError string
-
-func (err permFailError) Error() string {
-	return "dkim: " + string(err)
-}
-
-// IsPermFail returns true if the error returned by Verify is a permanent
-// failure. A permanent failure is for instance a missing required field or a
-// malformed header.
-func IsPermFail(err error) bool {
-	_, ok := err.(permFailError)
-	return ok
-}
-
-type tempFailError string
-
-func (err tempFailError) Error() string {
-	return "dkim: " + string(err)
-}
-
-// IsTempFail returns true if the error returned by Verify is a temporary
-// failure.
-func IsTempFail(err error) bool {
-	_, ok := err.(tempFailError)
-	return ok
-}
-
-type failError string
-
-func (err failError) Error() string {
-	return "dkim: " + string(err)
-}
-
-// isFail returns true if the error returned by Verify is a signature error.
-func isFail(err error) bool {
-	_, ok := err.(failError)
-	return ok
-}
-
-// ErrTooManySignatures is returned by Verify when the message exceeds the
-// maximum number of signatures.
-var ErrTooManySignatures = errors.New("dkim: too many signatures")
-
 var requiredTags = []string{"v", "a", "b", "bh", "d", "h", "s"}
 
 // A Verification is produced by Verify when it checks if one signature is
 // valid. If the signature is valid, Err is nil.
+//
+// A Verification can be marshaled to JSON. Err is then formatted as a string
+// in the "error" field.
 type Verification struct {
 	// The SDID claiming responsibility for an introduction of a message into the
 	// mail stream.
-	Domain string
+	Domain string `json:"domain"`
 	// The Agent or User Identifier (AUID) on behalf of which the SDID is taking
 	// responsibility.
-	Identifier string
+	Identifier string `json:"identifier"`
+	// The selector used to query the public key.
+	Selector string `json:"selector,omitempty"`
+
+	// The signing algorithm, e.g. "rsa-sha256".
+	Algorithm string `json:"algorithm,omitempty"`
+	// The header and body canonicalization algorithms.
+	HeaderCanonicalization Canonicalization `json:"header_canonicalization,omitempty"`
+	BodyCanonicalization   Canonicalization `json:"body_canonicalization,omitempty"`
 
 	// The list of signed header fields.
-	HeaderKeys []string
+	HeaderKeys []string `json:"header_keys"`
 
 	// The time that this signature was created. If unknown, it's set to zero.
-	Time time.Time
+	Time time.Time `json:"-"`
 	// The expiration time. If the signature doesn't expire, it's set to zero.
-	Expiration time.Time
+	Expiration time.Time `json:"-"`
+
+	// The number of canonicalized body bytes covered by the signature ("l="
+	// tag), and the number of canonicalized body bytes following them which
+	// aren't covered by the signature. These are only set if
+	// VerifyOptions.AllowBodyLength is true, otherwise signatures with a body
+	// length are rejected.
+	BodyLength         int64 `json:"body_length,omitempty"`
+	UnsignedBodyLength int64 `json:"unsigned_body_length,omitempty"`
+
+	// The public key type (e.g. "rsa") and size in bits, and the flags ("t="
+	// tag) and notes ("n=" tag) of the public key record. These are only set
+	// if the public key could be retrieved.
+	KeyAlgorithm string   `json:"key_algorithm,omitempty"`
+	KeySize      int      `json:"key_size,omitempty"`
+	KeyFlags     []string `json:"key_flags,omitempty"`
+	KeyNotes     string   `json:"key_notes,omitempty"`
+	// True if the public key record indicates that the domain is testing
+	// DKIM ("t=y" flag). Verifiers must not treat messages with such
+	// signatures differently from unsigned messages, see RFC 6376 section
+	// 3.6.1.
+	Testing bool `json:"testing,omitempty"`
+	// True if the signature uses a hash algorithm or a key size which is
+	// accepted by VerifyOptions.Policy, but considered weak. Err is nil if
+	// the signature is otherwise valid.
+	Weak bool `json:"weak,omitempty"`
+
+	// The signature data ("b=" tag), base64-encoded, with whitespace removed.
+	Signature string `json:"signature,omitempty"`
+	// True if the body hash matched. The signature may still be invalid if
+	// the header fields don't verify.
+	BodyHashMatched bool `json:"body_hash_matched"`
+
+	// If the signature failed to verify and contains a copy of the signed
+	// header fields ("z=" tag), the names of the signed header fields which
+	// differ from their copy. This is only meant for diagnostic purposes.
+	AlteredHeaderKeys []string `json:"altered_header_keys,omitempty"`
 
 	// Err is nil if the signature is valid.
-	Err error
+	Err error `json:"-"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (v Verification) MarshalJSON() ([]byte, error) {
+	type verification Verification
+	out := struct {
+		*verification
+		Time       *time.Time `json:"time,omitempty"`
+		Expiration *time.Time `json:"expiration,omitempty"`
+		Error      string     `json:"error,omitempty"`
+	}{verification: (*verification)(&v)}
+	if !v.Time.IsZero() {
+		out.Time = &v.Time
+	}
+	if !v.Expiration.IsZero() {
+		out.Expiration = &v.Expiration
+	}
+	if v.Err != nil {
+		out.Error = v.Err.Error()
+	}
+	return json.Marshal(&out)
 }
 
 type signature struct {
@@ -92,153 +117,441 @@ type signature struct {
 // behavior.
 type VerifyOptions struct {
 	// LookupTXT returns the DNS TXT records for the given domain name. If nil,
-	// net.LookupTXT is used.
+	// net.LookupTXT is used. Ignored if Resolver is set.
+	//
+	// The public keys of a message's signatures are looked up concurrently,
+	// so LookupTXT and Resolver must be safe for concurrent use.
 	LookupTXT func(domain string) ([]string, error)
+	// Resolver looks up public keys. If nil, LookupTXT is used.
+	Resolver Resolver
+	// KeyCache caches public keys across verifications. If nil, public keys
+	// are looked up for each signature.
+	KeyCache *KeyCache
 	// MaxVerifications controls the maximum number of signature verifications
 	// to perform. If more signatures are present, the first MaxVerifications
 	// signatures are verified, the rest are ignored and ErrTooManySignatures
 	// is returned. If zero, there is no maximum.
 	MaxVerifications int
+	// MaxHeaderBytes and MaxHeaderFields limit the size and the number of
+	// fields of the message header. If the header exceeds them, no signature
+	// is verified and a policy failure with the ErrLimitExceeded reason is
+	// returned, see IsPolicyFail. If zero, there is no limit.
+	MaxHeaderBytes  int
+	MaxHeaderFields int
+	// MaxSignatureLength limits the length of a DKIM-Signature header field,
+	// and MaxHeaderKeys the number of signed header fields ("h=" tag).
+	// Signatures exceeding them aren't checked and fail with a policy failure
+	// with the ErrLimitExceeded reason: this is a local policy decision, which
+	// says nothing about the validity of the signature. If zero, there is no
+	// limit.
+	MaxSignatureLength int
+	MaxHeaderKeys      int
+	// MaxDNSQueries limits the number of public key lookups per message. Each
+	// signature whose public key is looked up counts as one query, even if
+	// the key is in KeyCache. The signatures which would exceed the limit fail
+	// with a policy failure, as above. If zero, there is no limit.
+	MaxDNSQueries int
+	// AllowBodyLength enables verification of signatures with a body length
+	// ("l=" tag). Only the signed prefix of the body is verified, and the
+	// number of unsigned bytes is reported in Verification. If false,
+	// signatures with a body length fail with a policy failure.
+	AllowBodyLength bool
+	// Now returns the current time, used to check the signature time ("t="
+	// tag) and expiration ("x=" tag). If nil, time.Now is used.
+	Now func() time.Time
+	// MaxClockSkew is the tolerated difference between the verifier's and the
+	// signer's clocks. Signatures created further in the future, or which
+	// expired further in the past, are rejected. If zero, DefaultMaxClockSkew
+	// is used for the signature time, and expiration times are enforced
+	// strictly. If negative, no difference is tolerated.
+	MaxClockSkew time.Duration
+	// Policy controls the accepted hash algorithms and key sizes. If nil, the
+	// default policy is used, see Policy.
+	Policy *Policy
 }
 
-// Verify checks if a message's signatures are valid. It returns one
-// verification per signature.
+// DefaultMaxClockSkew is the default tolerated difference between the
+// verifier's and the signer's clocks for the signature time. It doesn't apply
+// to expiration times.
+const DefaultMaxClockSkew = 5 * time.Minute
+
+func (options *VerifyOptions) policy() *Policy {
+	if options != nil && options.Policy != nil {
+		return options.Policy
+	}
+	return &defaultPolicy
+}
+
+func (options *VerifyOptions) txtLookup() txtLookupFunc {
+	if r, ok := options.Resolver.(TTLResolver); ok {
+		return r.LookupTXTWithTTL
+	}
+	if options.Resolver != nil {
+		return func(ctx context.Context, domain string) ([]string, time.Duration, error) {
+			txts, err := options.Resolver.LookupTXT(ctx, domain)
+			return txts, 0, err
+		}
+	}
+	if options.LookupTXT != nil {
+		return func(ctx context.Context, domain string) ([]string, time.Duration, error) {
+			txts, err := options.LookupTXT(domain)
+			return txts, 0, err
+		}
+	}
+	return nil
+}
+
+// Verifier verifies the DKIM signatures of a message.
 //
-// There is no guarantee that the reader will be completely consumed.
-func Verify(r io.Reader) ([]*Verification, error) {
-	return VerifyWithOptions(r, nil)
+// The whole message header and body must be written to the Verifier. Close
+// should always be called (either after the whole message has been written,
+// or after an error occured and the verifier won't be used anymore), unless
+// the verification is abandoned with Abort. After Close, Verifications can be
+// called to retrieve the results.
+//
+// The header is parsed and the body is hashed as they are written, in the
+// caller's goroutine. Once the header has been parsed, Write starts one
+// goroutine per signature to look up its public key, so that the lookups
+// overlap with body hashing. Each of these goroutines exits when its lookup
+// completes or when the context passed to NewVerifierWithContext is done.
+// Close and Abort wait for all of them.
+type Verifier struct {
+	ctx     context.Context
+	options *VerifyOptions
+	hp      headerParser
+	hlen    int // number of header bytes written so far
+	closed  bool
+	err     error
+
+	// Only valid after the header has been parsed
+	cancel            context.CancelFunc
+	wg                sync.WaitGroup
+	svs               []*sigVerification
+	hashers           bodyHasherSet
+	tooManySignatures bool
+
+	verifs []*Verification // only valid after Close
 }
 
-// VerifyWithOptions performs the same task as Verify, but allows specifying
-// verification options.
-func VerifyWithOptions(r io.Reader, options *VerifyOptions) ([]*Verification, error) {
-	// Read header
-	bufr := bufio.NewReader(r)
-	h, err := readHeader(bufr)
-	if err != nil {
-		return nil, err
+var (
+	errVerifierClosed  = errors.New("dkim: write on closed Verifier")
+	errVerifierAborted = errors.New("dkim: verification aborted")
+)
+
+// NewVerifier creates a new verifier.
+func NewVerifier(options *VerifyOptions) *Verifier {
+	return NewVerifierWithContext(context.Background(), options)
+}
+
+// NewVerifierWithContext creates a new verifier which uses ctx for public key
+// lookups. If ctx is canceled or times out, pending lookups fail with a
+// temporary failure.
+func NewVerifierWithContext(ctx context.Context, options *VerifyOptions) *Verifier {
+	return &Verifier{ctx: ctx, options: options}
+}
+
+// Write implements io.WriteCloser.
+func (v *Verifier) Write(b []byte) (n int, err error) {
+	if v.closed {
+		return 0, errVerifierClosed
+	} else if v.err != nil {
+		return 0, v.err
+	}
+
+	n = len(b)
+	if v.hashers == nil {
+		consumed := v.hp.parse(b)
+		v.hlen += consumed
+		if err := v.checkHeaderLimits(); err != nil {
+			v.err = err
+			return 0, err
+		}
+		if !v.hp.done {
+			return n, nil
+		}
+		v.start()
+		b = b[consumed:]
 	}
 
+	if _, err := v.hashers.Write(b); err != nil {
+		v.err = err
+		return 0, err
+	}
+	return n, nil
+}
+
+// checkHeaderLimits checks that the header written so far doesn't exceed the
+// limits set in VerifyOptions.
+func (v *Verifier) checkHeaderLimits() error {
+	options := v.options
+	if options == nil {
+		return nil
+	}
+	if options.MaxHeaderBytes > 0 && v.hlen > options.MaxHeaderBytes {
+		return policyError(ErrLimitExceeded, fmt.Sprintf("header exceeds %v bytes", options.MaxHeaderBytes))
+	}
+	if options.MaxHeaderFields > 0 && v.hp.fields() > options.MaxHeaderFields {
+		return policyError(ErrLimitExceeded, fmt.Sprintf("header has more than %v fields", options.MaxHeaderFields))
+	}
+	return nil
+}
+
+// start checks the signatures once the header has been parsed, and starts
+// querying public keys. The body is hashed once per distinct body hash
+// computation while the lookups run. The result is shared by all signatures
+// which need it.
+func (v *Verifier) start() {
+	h, options := v.hp.h, v.options
+
 	// Scan header fields for signatures
 	var signatures []*signature
 	for i, kv := range h {
-		k, v := parseHeaderField(kv)
+		k, val := parseHeaderField(kv)
 		if strings.EqualFold(k, headerFieldName) {
-			signatures = append(signatures, &signature{i, v})
+			signatures = append(signatures, &signature{i, val})
 		}
 	}
 
-	tooManySignatures := false
 	if options != nil && options.MaxVerifications > 0 && len(signatures) > options.MaxVerifications {
-		tooManySignatures = true
+		v.tooManySignatures = true
 		signatures = signatures[:options.MaxVerifications]
 	}
 
-	var verifs []*Verification
-	if len(signatures) == 1 {
-		// If there is only one signature - just verify it.
-		v, err := verify(h, bufr, h[signatures[0].i], signatures[0].v, options)
-		if err != nil && !IsTempFail(err) && !IsPermFail(err) && !isFail(err) {
-			return nil, err
+	var ctx context.Context
+	ctx, v.cancel = context.WithCancel(v.ctx)
+	v.hashers = make(bodyHasherSet)
+	v.svs = make([]*sigVerification, len(signatures))
+	queries := 0
+	for i, sig := range signatures {
+		sv := newSigVerification(h[sig.i], sig.v, options)
+		v.svs[i] = sv
+		if sv.err != nil {
+			continue
 		}
-		v.Err = err
-		verifs = []*Verification{v}
-	} else {
-		verifs, err = parallelVerify(bufr, h, signatures, options)
-		if err != nil {
-			return nil, err
+		if options != nil && options.MaxDNSQueries > 0 && queries >= options.MaxDNSQueries {
+			sv.err = policyError(ErrLimitExceeded, fmt.Sprintf("more than %v DNS queries", options.MaxDNSQueries))
+			continue
 		}
+		queries++
+		if sv.canHashBody() {
+			v.hashers.get(sv.bodyHashKey)
+		}
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+			sv.err = sv.lookupKey(ctx, options)
+		}()
 	}
+}
 
-	if tooManySignatures {
-		return verifs, ErrTooManySignatures
+// stop cancels pending public key lookups and waits for them to complete.
+func (v *Verifier) stop() {
+	if v.cancel != nil {
+		v.cancel()
 	}
-	return verifs, nil
+	v.wg.Wait()
 }
 
-func parallelVerify(r io.Reader, h header, signatures []*signature, options *VerifyOptions) ([]*Verification, error) {
-	pipeWriters := make([]*io.PipeWriter, len(signatures))
-	// We can't pass pipeWriter to io.MultiWriter directly,
-	// we need a slice of io.Writer, but we also need *io.PipeWriter
-	// to call Close on it.
-	writers := make([]io.Writer, len(signatures))
-	chans := make([]chan *Verification, len(signatures))
+// Close implements io.WriteCloser. It returns ErrTooManySignatures if the
+// message has more signatures than VerifyOptions.MaxVerifications, in which
+// case Verifications can still be called. Any other error must be checked.
+func (v *Verifier) Close() error {
+	if v.closed {
+		return v.err
+	}
+	v.closed = true
+	if v.err != nil {
+		v.stop()
+		return v.err
+	}
 
-	for i, sig := range signatures {
-		// Be careful with loop variables and goroutines.
-		i, sig := i, sig
+	if v.hashers == nil {
+		v.err = fmt.Errorf("failed to read header: %v", io.EOF)
+		return v.err
+	}
+	if err := v.hashers.Close(); err != nil {
+		v.err = err
+		v.stop()
+		return err
+	}
+	v.wg.Wait()
+	v.cancel()
 
-		chans[i] = make(chan *Verification, 1)
+	for _, sv := range v.svs {
+		if sv.err == nil {
+			sv.err = sv.checkKey(v.options)
+		}
+		if sv.err == nil {
+			sv.bh = v.hashers[sv.bodyHashKey]
+		}
+	}
 
-		pr, pw := io.Pipe()
-		writers[i] = pw
-		pipeWriters[i] = pw
+	verifs := make([]*Verification, len(v.svs))
+	for i, sv := range v.svs {
+		if sv.err == nil {
+			sv.err = sv.finish(v.hp.h)
+		}
 
-		go func() {
-			v, err := verify(h, pr, h[sig.i], sig.v, options)
+		// Return unexpected failures as a separate error.
+		err := sv.err
+		var dkimErr *Error
+		if err != nil && !errors.As(err, &dkimErr) {
+			v.err = err
+			return err
+		}
+		sv.verif.Err = err
+		verifs[i] = sv.verif
+	}
+	v.verifs = verifs
 
-			// Make sure we consume the whole reader, otherwise io.Copy on
-			// other side can block forever.
-			io.Copy(ioutil.Discard, pr)
+	if v.tooManySignatures {
+		v.err = ErrTooManySignatures
+	}
+	return v.err
+}
 
-			v.Err = err
-			chans[i] <- v
-		}()
+// Abort abandons the verification: pending public key lookups are canceled,
+// and Abort waits for their goroutines to exit. Further calls to Write and
+// Close fail, and Verifications returns nil. Abort does nothing if the
+// verifier has already been closed.
+func (v *Verifier) Abort() {
+	if v.closed {
+		return
 	}
+	v.closed = true
+	if v.err == nil {
+		v.err = errVerifierAborted
+	}
+	v.stop()
+}
 
-	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+// Verifications returns one verification per signature. It can only be
+// called after Close, and returns nil if Close failed with an error other
+// than ErrTooManySignatures.
+func (v *Verifier) Verifications() []*Verification {
+	return v.verifs
+}
+
+// Verify checks if a message's signatures are valid. It returns one
+// verification per signature.
+//
+// There is no guarantee that the reader will be completely consumed.
+func Verify(r io.Reader) ([]*Verification, error) {
+	return VerifyWithOptions(r, nil)
+}
+
+// VerifyWithOptions performs the same task as Verify, but allows specifying
+// verification options.
+func VerifyWithOptions(r io.Reader, options *VerifyOptions) ([]*Verification, error) {
+	return VerifyWithContext(context.Background(), r, options)
+}
+
+// VerifyWithContext performs the same task as VerifyWithOptions, but uses
+// ctx for public key lookups. If ctx is canceled or times out, pending
+// lookups fail with a temporary failure.
+func VerifyWithContext(ctx context.Context, r io.Reader, options *VerifyOptions) ([]*Verification, error) {
+	v := NewVerifierWithContext(ctx, options)
+	if _, err := io.Copy(v, r); err != nil {
+		v.Abort()
 		return nil, err
 	}
-	for _, wr := range pipeWriters {
-		wr.Close()
+	err := v.Close()
+	if err != nil && err != ErrTooManySignatures {
+		return nil, err
 	}
+	return v.Verifications(), err
+}
 
-	verifications := make([]*Verification, len(signatures))
-	for i, ch := range chans {
-		verifications[i] = <-ch
-	}
+// sigVerification holds the state of the verification of a single signature.
+// A verification is performed in several steps: newSigVerification checks the
+// signature and parses the body hash parameters, lookupKey retrieves the
+// public key while the body is hashed, checkKey checks the public key, and
+// finish checks the body hash and signature once the body has been hashed. If
+// a step fails, the error is stored in err and the following steps must be
+// skipped.
+type sigVerification struct {
+	verif      *Verification
+	err        error
+	sigField   string
+	params     map[string]string
+	headerKeys []string
+	res        *queryResult
+
+	keyAlgo     string
+	hashAlgo    string
+	hash        crypto.Hash
+	weakHash    bool
+	bodyHashKey bodyHashKey
+	// Errors found by parseBodyHash are reported by checkKey, interleaved
+	// with the public key checks.
+	algoErr    error
+	hashErr    error
+	bodyCanErr error
+	bodyLenErr error
+	bodyHashed []byte
+	sig        []byte
+	bh         *bodyHasher
+}
 
-	// Return unexpected failures as a separate error.
-	for _, v := range verifications {
-		err := v.Err
-		if err != nil && !IsTempFail(err) && !IsPermFail(err) && !isFail(err) {
-			v.Err = nil
-			return verifications, err
-		}
+func newSigVerification(sigField, sigValue string, options *VerifyOptions) *sigVerification {
+	sv := &sigVerification{verif: new(Verification), sigField: sigField}
+	sv.err = sv.checkSignature(sigValue, options)
+	if sv.err == nil {
+		sv.parseBodyHash(options)
 	}
-	return verifications, nil
+	return sv
+}
+
+// canHashBody returns whether the body hash parameters are valid.
+func (sv *sigVerification) canHashBody() bool {
+	return sv.algoErr == nil && sv.hashErr == nil && sv.bodyCanErr == nil && sv.bodyLenErr == nil
 }
 
-func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOptions) (*Verification, error) {
-	verif := new(Verification)
+func (sv *sigVerification) checkSignature(sigValue string, options *VerifyOptions) error {
+	verif := sv.verif
+
+	if options != nil && options.MaxSignatureLength > 0 && len(sv.sigField) > options.MaxSignatureLength {
+		return policyError(ErrLimitExceeded, fmt.Sprintf("signature exceeds %v bytes", options.MaxSignatureLength))
+	}
 
 	params, err := parseHeaderParams(sigValue)
 	if err != nil {
-		return verif, permFailError("malformed signature tags: " + err.Error())
+		return permFailError(ErrSignatureSyntax, err.Error())
 	}
+	sv.params = params
 
 	if params["v"] != "1" {
-		return verif, permFailError("incompatible signature version")
+		return permFailError(ErrIncompatibleVersion, "")
 	}
 
 	verif.Domain = stripWhitespace(params["d"])
+	verif.Selector = stripWhitespace(params["s"])
+	verif.Algorithm = stripWhitespace(params["a"])
+	verif.Signature = stripWhitespace(params["b"])
+
+	headerCan, bodyCan := parseCanonicalization(params["c"])
+	verif.HeaderCanonicalization = headerCan
+	verif.BodyCanonicalization = bodyCan
 
 	for _, tag := range requiredTags {
 		if _, ok := params[tag]; !ok {
-			return verif, permFailError("signature missing required tag")
+			return permFailError(ErrMissingRequiredTag, tag)
 		}
 	}
 
 	if i, ok := params["i"]; ok {
 		verif.Identifier = stripWhitespace(i)
 		if !strings.HasSuffix(verif.Identifier, "@"+verif.Domain) && !strings.HasSuffix(verif.Identifier, "."+verif.Domain) {
-			return verif, permFailError("domain mismatch")
+			return permFailError(ErrDomainMismatch, "")
 		}
 	} else {
 		verif.Identifier = "@" + verif.Domain
 	}
 
 	headerKeys := parseTagList(params["h"])
+	if options != nil && options.MaxHeaderKeys > 0 && len(headerKeys) > options.MaxHeaderKeys {
+		return policyError(ErrLimitExceeded, fmt.Sprintf("more than %v signed header fields", options.MaxHeaderKeys))
+	}
 	ok := false
 	for _, k := range headerKeys {
 		if strings.EqualFold(k, "from") {
@@ -247,87 +560,178 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 		}
 	}
 	if !ok {
-		return verif, permFailError("From field not signed")
+		return permFailError(ErrFromNotSigned, "")
 	}
 	verif.HeaderKeys = headerKeys
+	sv.headerKeys = headerKeys
+
+	// The signer chose the expiration time, only tolerate a clock skew for
+	// it if explicitly configured.
+	nowFunc, skew, expSkew := now, DefaultMaxClockSkew, time.Duration(0)
+	if options != nil {
+		if options.Now != nil {
+			nowFunc = options.Now
+		}
+		if options.MaxClockSkew < 0 {
+			skew = 0
+		} else if options.MaxClockSkew > 0 {
+			skew, expSkew = options.MaxClockSkew, options.MaxClockSkew
+		}
+	}
+	current := nowFunc()
 
 	if timeStr, ok := params["t"]; ok {
 		t, err := parseTime(timeStr)
 		if err != nil {
-			return verif, permFailError("malformed time: " + err.Error())
+			return permFailError(ErrSignatureSyntax, "malformed time: "+err.Error())
 		}
 		verif.Time = t
+		if t.After(current.Add(skew)) {
+			return permFailError(ErrSignatureInFuture, "")
+		}
 	}
 	if expiresStr, ok := params["x"]; ok {
 		t, err := parseTime(expiresStr)
 		if err != nil {
-			return verif, permFailError("malformed expiration time: " + err.Error())
+			return permFailError(ErrSignatureSyntax, "malformed expiration time: "+err.Error())
 		}
 		verif.Expiration = t
-		if now().After(t) {
-			return verif, permFailError("signature has expired")
+		if !verif.Time.IsZero() && !t.After(verif.Time) {
+			return permFailError(ErrExpirationBeforeTime, "")
+		}
+		if current.After(t.Add(expSkew)) {
+			return permFailError(ErrSignatureExpired, "")
 		}
 	}
 
-	// Query public key
-	// TODO: compute hash in parallel
+	return nil
+}
+
+// lookupKey queries the public key.
+func (sv *sigVerification) lookupKey(ctx context.Context, options *VerifyOptions) error {
+	verif := sv.verif
+
 	methods := []string{string(QueryMethodDNSTXT)}
-	if methodsStr, ok := params["q"]; ok {
+	if methodsStr, ok := sv.params["q"]; ok {
 		methods = parseTagList(methodsStr)
 	}
 	var res *queryResult
+	var err error
 	for _, method := range methods {
 		if query, ok := queryMethods[QueryMethod(method)]; ok {
-			if options != nil {
-				res, err = query(verif.Domain, stripWhitespace(params["s"]), options.LookupTXT)
+			if options != nil && options.KeyCache != nil {
+				res, err = options.KeyCache.query(ctx, QueryMethod(method), query, verif.Domain, verif.Selector, options.txtLookup())
+			} else if options != nil {
+				res, _, err = query(ctx, verif.Domain, verif.Selector, options.txtLookup())
 			} else {
-				res, err = query(verif.Domain, stripWhitespace(params["s"]), nil)
+				res, _, err = query(ctx, verif.Domain, verif.Selector, nil)
 			}
 			break
 		}
 	}
 	if err != nil {
-		return verif, err
+		return err
 	} else if res == nil {
-		return verif, permFailError("unsupported public key query method")
+		return permFailError(ErrUnsupportedQueryMethod, "")
 	}
+	sv.res = res
+	return nil
+}
 
-	// Parse algos
-	algos := strings.SplitN(stripWhitespace(params["a"]), "-", 2)
+// parseBodyHash parses the signature algorithm, the body canonicalization
+// and the body length, which determine the body hash computation. This allows
+// the body to be hashed while the public key is looked up. Errors are stored
+// in sv, checkKey reports them.
+func (sv *sigVerification) parseBodyHash(options *VerifyOptions) {
+	verif, params := sv.verif, sv.params
+
+	algos := strings.SplitN(verif.Algorithm, "-", 2)
 	if len(algos) != 2 {
-		return verif, permFailError("malformed algorithm name")
+		sv.algoErr = permFailError(ErrSignatureSyntax, "malformed algorithm name")
+		return
+	}
+	sv.keyAlgo, sv.hashAlgo = algos[0], algos[1]
+
+	sv.hash, sv.weakHash, sv.hashErr = options.policy().hash(sv.hashAlgo)
+
+	bodyCan := verif.BodyCanonicalization
+	if LookupCanonicalizer(bodyCan) == nil {
+		sv.bodyCanErr = permFailError(ErrUnsupportedAlgorithm, "body canonicalization "+string(bodyCan))
+	}
+
+	// The body length "l" parameter is insecure, because it allows parts of
+	// the message body to not be signed. Reject messages which have it set,
+	// unless explicitly allowed.
+	bodyLen := int64(-1)
+	if lenStr, ok := params["l"]; ok {
+		if options == nil || !options.AllowBodyLength {
+			sv.bodyLenErr = policyError(ErrBodyLength, "")
+			return
+		}
+		l, err := strconv.ParseInt(stripWhitespace(lenStr), 10, 64)
+		if err != nil || l < 0 {
+			sv.bodyLenErr = permFailError(ErrSignatureSyntax, "malformed body length")
+			return
+		}
+		bodyLen = l
+	}
+	sv.bodyHashKey = bodyHashKey{bodyCan, sv.hash, bodyLen}
+}
+
+// checkKey checks that the public key can be used to verify the signature,
+// and parses the remaining signature tags.
+func (sv *sigVerification) checkKey(options *VerifyOptions) error {
+	verif, params, res := sv.verif, sv.params, sv.res
+
+	verif.KeyAlgorithm = res.KeyAlgo
+	verif.KeySize = res.KeySize
+	verif.KeyFlags = res.Flags
+	verif.KeyNotes = res.Notes
+	verif.Testing = hasTagValue(res.Flags, "y")
+
+	policy := options.policy()
+	weakKey, err := policy.checkKeySize(res.KeyAlgo, res.KeySize)
+	if err != nil {
+		return err
+	}
+
+	// The "s" flag requires the AUID domain to be the same as the SDID,
+	// subdomains aren't allowed
+	if _, ok := params["i"]; ok && hasTagValue(res.Flags, "s") {
+		idDomain := verif.Identifier[strings.LastIndex(verif.Identifier, "@")+1:]
+		if !strings.EqualFold(idDomain, verif.Domain) {
+			return permFailError(ErrDomainMismatch, "key doesn't allow subdomains in identity")
+		}
+	}
+
+	if sv.algoErr != nil {
+		return sv.algoErr
 	}
-	keyAlgo := algos[0]
-	hashAlgo := algos[1]
 
 	// Check hash algo
 	if res.HashAlgos != nil {
 		ok := false
 		for _, algo := range res.HashAlgos {
-			if algo == hashAlgo {
+			if algo == sv.hashAlgo {
 				ok = true
 				break
 			}
 		}
 		if !ok {
-			return verif, permFailError("inappropriate hash algorithm")
+			return permFailError(ErrInappropriateHashAlgorithm, "")
 		}
 	}
-	var hash crypto.Hash
-	switch hashAlgo {
-	case "sha1":
-		// RFC 8301 section 3.1: rsa-sha1 MUST NOT be used for signing or
-		// verifying.
-		return verif, permFailError(fmt.Sprintf("hash algorithm too weak: %v", hashAlgo))
-	case "sha256":
-		hash = crypto.SHA256
-	default:
-		return verif, permFailError("unsupported hash algorithm")
+	if sv.hashErr != nil {
+		return sv.hashErr
 	}
 
 	// Check key algo
-	if res.KeyAlgo != keyAlgo {
-		return verif, permFailError("inappropriate key algorithm")
+	if res.KeyAlgo != sv.keyAlgo {
+		return permFailError(ErrInappropriateKeyAlgorithm, "")
+	}
+	// RFC 8463 section 3: Ed25519 is only defined with sha256
+	if sv.keyAlgo == KeyAlgoEd25519 && sv.hash != crypto.SHA256 {
+		return permFailError(ErrUnsupportedAlgorithm, verif.Algorithm)
 	}
 
 	if res.Services != nil {
@@ -339,52 +743,60 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 			}
 		}
 		if !ok {
-			return verif, permFailError("inappropriate service")
+			return permFailError(ErrInappropriateService, "")
 		}
 	}
 
-	headerCan, bodyCan := parseCanonicalization(params["c"])
-	if _, ok := canonicalizers[headerCan]; !ok {
-		return verif, permFailError("unsupported header canonicalization algorithm")
+	headerCan := verif.HeaderCanonicalization
+	if LookupCanonicalizer(headerCan) == nil {
+		return permFailError(ErrUnsupportedAlgorithm, "header canonicalization "+string(headerCan))
 	}
-	if _, ok := canonicalizers[bodyCan]; !ok {
-		return verif, permFailError("unsupported body canonicalization algorithm")
+	if sv.bodyCanErr != nil {
+		return sv.bodyCanErr
 	}
-
-	// The body length "l" parameter is insecure, because it allows parts of
-	// the message body to not be signed. Reject messages which have it set.
-	if _, ok := params["l"]; ok {
-		// TODO: technically should be policyError
-		return verif, failError("message contains an insecure body length tag")
+	if sv.bodyLenErr != nil {
+		return sv.bodyLenErr
 	}
 
 	// Parse body hash and signature
-	bodyHashed, err := decodeBase64String(params["bh"])
+	sv.bodyHashed, err = decodeBase64String(params["bh"])
 	if err != nil {
-		return verif, permFailError("malformed body hash: " + err.Error())
+		return permFailError(ErrSignatureSyntax, "malformed body hash: "+err.Error())
 	}
-	sig, err := decodeBase64String(params["b"])
+	sv.sig, err = base64.StdEncoding.DecodeString(verif.Signature)
 	if err != nil {
-		return verif, permFailError("malformed signature: " + err.Error())
+		return permFailError(ErrSignatureSyntax, "malformed signature: "+err.Error())
 	}
 
+	verif.Weak = weakKey || sv.weakHash
+	return nil
+}
+
+// finish checks the body hash and the signature. It must be called after the
+// body hasher has been closed.
+func (sv *sigVerification) finish(h header) error {
+	verif, params, bh := sv.verif, sv.params, sv.bh
+	headerCan := verif.HeaderCanonicalization
+
 	// Check body hash
-	hasher := hash.New()
-	wc := canonicalizers[bodyCan].CanonicalizeBody(hasher)
-	if _, err := io.Copy(wc, r); err != nil {
-		return verif, err
-	}
-	if err := wc.Close(); err != nil {
-		return verif, err
+	if bodyLen := sv.bodyHashKey.limit; bodyLen >= 0 {
+		if bh.Len() < bodyLen {
+			return failError(ErrBodyHashMismatch, "body length tag exceeds body length")
+		}
+		verif.BodyLength = bodyLen
+		verif.UnsignedBodyLength = bh.Len() - bodyLen
 	}
-	if subtle.ConstantTimeCompare(hasher.Sum(nil), bodyHashed) != 1 {
-		return verif, failError("body hash did not verify")
+	if subtle.ConstantTimeCompare(bh.Sum(), sv.bodyHashed) != 1 {
+		verif.AlteredHeaderKeys = diffCopiedHeaderFields(h, sv.headerKeys, params["z"], headerCan)
+		return failError(ErrBodyHashMismatch, "")
 	}
+	verif.BodyHashMatched = true
 
 	// Compute data hash
-	hasher.Reset()
+	hasher := sv.hash.New()
+	headerCanonicalizer := LookupCanonicalizer(headerCan)
 	picker := newHeaderPicker(h)
-	for _, key := range headerKeys {
+	for _, key := range sv.headerKeys {
 		kv := picker.Pick(key)
 		if kv == "" {
 			// The field MAY contain names of header fields that do not exist
@@ -393,25 +805,55 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 			continue
 		}
 
-		kv = canonicalizers[headerCan].CanonicalizeHeader(kv)
+		kv = headerCanonicalizer.CanonicalizeHeader(kv)
 		if _, err := hasher.Write([]byte(kv)); err != nil {
-			return verif, err
+			return err
 		}
 	}
-	canSigField := removeSignature(sigField)
-	canSigField = canonicalizers[headerCan].CanonicalizeHeader(canSigField)
+	canSigField := removeSignature(sv.sigField)
+	canSigField = headerCanonicalizer.CanonicalizeHeader(canSigField)
 	canSigField = strings.TrimRight(canSigField, "\r\n")
 	if _, err := hasher.Write([]byte(canSigField)); err != nil {
-		return verif, err
+		return err
 	}
 	hashed := hasher.Sum(nil)
 
 	// Check signature
-	if err := res.Verifier.Verify(hash, hashed, sig); err != nil {
-		return verif, failError("signature did not verify: " + err.Error())
+	if err := sv.res.Verifier.Verify(sv.hash, hashed, sv.sig); err != nil {
+		verif.AlteredHeaderKeys = diffCopiedHeaderFields(h, sv.headerKeys, params["z"], headerCan)
+		return failError(ErrSignatureMismatch, err.Error())
 	}
 
-	return verif, nil
+	return nil
+}
+
+// diffCopiedHeaderFields returns the names of the signed header fields which
+// differ from the copies in the "z=" tag value z.
+func diffCopiedHeaderFields(h header, headerKeys []string, z string, headerCan Canonicalization) []string {
+	if z == "" {
+		return nil
+	}
+	copies, err := parseCopiedHeaderFields(z)
+	if err != nil {
+		return nil
+	}
+
+	// The copies are in the same order as the signed header fields
+	copyPicker := newHeaderPicker(reverseHeader(copies))
+	picker := newHeaderPicker(h)
+	can := LookupCanonicalizer(headerCan)
+	var altered []string
+	for _, key := range headerKeys {
+		kv := picker.Pick(key)
+		copied := copyPicker.Pick(key)
+		if kv == "" && copied == "" {
+			continue
+		}
+		if kv == "" || copied == "" || can.CanonicalizeHeader(kv) != can.CanonicalizeHeader(copied) {
+			altered = append(altered, key)
+		}
+	}
+	return altered
 }
 
 func parseTagList(s string) []string {
@@ -422,6 +864,15 @@ func parseTagList(s string) []string {
 	return tags
 }
 
+func hasTagValue(l []string, v string) bool {
+	for _, s := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
 func parseCanonicalization(s string) (headerCan, bodyCan Canonicalization) {
 	headerCan = CanonicalizationSimple
 	bodyCan = CanonicalizationSimple
@@ -457,6 +908,16 @@ func stripWhitespace(s string) string {
 	}, s)
 }
 
+// removeSignature removes the value of the "b=" tag from a DKIM-Signature
+// header field.
 func removeSignature(s string) string {
-	return regexp.MustCompile(`(b\s*=)[^;]+`).ReplaceAllString(s, "$1")
+	i := strings.IndexByte(s, ':')
+	tags := strings.Split(s[i+1:], ";")
+	for j, tag := range tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "b" {
+			tags[j] = kv[0] + "="
+		}
+	}
+	return s[:i+1] + strings.Join(tags, ";")
 }
@@ -1,10 +1,16 @@
 package dkim
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -62,9 +68,20 @@ Joe.
 `
 
 var testVerification = &Verification{
-	Domain:     "example.com",
-	Identifier: "joe@football.example.com",
-	HeaderKeys: []string{"Received", "From", "To", "Subject", "Date", "Message-ID"},
+	Domain:                 "example.com",
+	Identifier:             "joe@football.example.com",
+	Selector:               "brisbane",
+	Algorithm:              "rsa-sha256",
+	HeaderCanonicalization: CanonicalizationSimple,
+	BodyCanonicalization:   CanonicalizationSimple,
+	HeaderKeys:             []string{"Received", "From", "To", "Subject", "Date", "Message-ID"},
+	KeyAlgorithm:           "rsa",
+	KeySize:                1024,
+	Signature: "AuUoFEfDxTDkHlLXSZEpZj79LICEps6eda7W3deTVFOk4yAUoqOB" +
+		"4nujc7YopdG5dWLSdNg6xNAZpOPr+kHxt1IrE+NahM6L/LbvaHut" +
+		"KVdkLLkpVaVVQPzeRDI009SO2Il5Lu7rDNH6mZckBdrIx0orEtZV" +
+		"4bmp/YzhwvcubU4=",
+	BodyHashMatched: true,
 }
 
 func TestVerify(t *testing.T) {
@@ -137,16 +154,29 @@ Joe.
 `
 
 var testRawRSAVerification = &Verification{
-	Domain:     "example.com",
-	Identifier: "joe@football.example.com",
-	HeaderKeys: []string{"Received", "From", "To", "Subject", "Date", "Message-ID"},
-	Time:       time.Unix(1615825284, 0),
+	Domain:                 "example.com",
+	Identifier:             "joe@football.example.com",
+	Selector:               "newengland",
+	Algorithm:              "rsa-sha256",
+	HeaderCanonicalization: CanonicalizationSimple,
+	BodyCanonicalization:   CanonicalizationSimple,
+	HeaderKeys:             []string{"Received", "From", "To", "Subject", "Date", "Message-ID"},
+	Time:                   time.Unix(1615825284, 0),
+	KeyAlgorithm:           "rsa",
+	KeySize:                1024,
+	Signature: "Xh4Ujb2wv5x54gXtulCiy4C0e+plRm6pZ4owF+kICpYzs/8WkTVIDBrzhJP0DAYCpnL62T0G" +
+		"k+0OH8pi/yqETVjKtKk+peMnNvKkut0GeWZMTze0bfq3/JUK3Ln3jTzzpXxrgVnvBxeY9EZI" +
+		"L4gs4wwFRRKz/1bksZGSjD8uuSU=",
+	BodyHashMatched: true,
 }
 
 func TestVerify_rawRSA(t *testing.T) {
 	r := newMailStringReader(verifiedRawRSAMailString)
+	options := &VerifyOptions{
+		Now: func() time.Time { return testRawRSAVerification.Time },
+	}
 
-	verifications, err := Verify(r)
+	verifications, err := VerifyWithOptions(r, options)
 	if err != nil {
 		t.Fatalf("Expected no error while verifying signature, got: %v", err)
 	} else if len(verifications) != 1 {
@@ -159,6 +189,62 @@ func TestVerify_rawRSA(t *testing.T) {
 	}
 }
 
+// Taken from RFC 8463 appendix A.3
+const verifiedEd25519MailString = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+var testEd25519Verification = &Verification{
+	Domain:                 "football.example.com",
+	Identifier:             "@football.example.com",
+	Selector:               "brisbane",
+	Algorithm:              "ed25519-sha256",
+	HeaderCanonicalization: CanonicalizationRelaxed,
+	BodyCanonicalization:   CanonicalizationRelaxed,
+	HeaderKeys:             []string{"from", "to", "subject", "date", "message-id", "from", "subject", "date"},
+	Time:                   time.Unix(1528637909, 0),
+	KeyAlgorithm:           "ed25519",
+	KeySize:                256,
+	Signature: "/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7Zbn" +
+		"KELq+eXdp1Q1Dw==",
+	BodyHashMatched: true,
+}
+
+func TestVerify_ed25519(t *testing.T) {
+	r := newMailStringReader(verifiedEd25519MailString)
+	options := &VerifyOptions{
+		Now: func() time.Time { return testEd25519Verification.Time },
+	}
+
+	verifications, err := VerifyWithOptions(r, options)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if !reflect.DeepEqual(testEd25519Verification, v) {
+		t.Errorf("Expected verification to be \n%+v\n but got \n%+v", testEd25519Verification, v)
+	}
+}
+
 // errorReader reads from r and then returns an arbitrary error.
 type errorReader struct {
 	r   io.Reader
@@ -224,3 +310,555 @@ func TestVerify_tooManySignatures(t *testing.T) {
 		t.Fatalf("Expected %v verifications, got %v", options.MaxVerifications, len(verifs))
 	}
 }
+
+func TestVerify_clock(t *testing.T) {
+	signTime := time.Unix(1000000, 0)
+	options := &SignOptions{
+		Domain:     "example.org",
+		Selector:   "brisbane",
+		Signer:     testPrivateKey,
+		Expiration: signTime.Add(time.Hour),
+		Now:        func() time.Time { return signTime },
+	}
+
+	var b bytes.Buffer
+	if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+		t.Fatal("Expected no error while signing mail, got:", err)
+	}
+	signed := b.String()
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		skew  time.Duration
+		valid bool
+	}{
+		{"valid", signTime.Add(time.Minute), 0, true},
+		{"future", signTime.Add(-time.Hour), 0, false},
+		{"future within skew", signTime.Add(-time.Minute), 0, true},
+		{"future without skew", signTime.Add(-time.Second), -1, false},
+		{"future within custom skew", signTime.Add(-time.Hour), 2 * time.Hour, true},
+		{"expired", signTime.Add(2 * time.Hour), 0, false},
+		{"expired just now", signTime.Add(time.Hour + time.Second), 0, false},
+		{"expired within custom skew", signTime.Add(time.Hour + time.Minute), 5 * time.Minute, true},
+		{"expired without skew", signTime.Add(time.Hour + time.Second), -1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current := test.now
+			verifications, err := VerifyWithOptions(strings.NewReader(signed), &VerifyOptions{
+				Now:          func() time.Time { return current },
+				MaxClockSkew: test.skew,
+			})
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+
+			err = verifications[0].Err
+			if test.valid && err != nil {
+				t.Errorf("Expected no error when verifying signature, got: %v", err)
+			} else if !test.valid && !IsPermFail(err) {
+				t.Errorf("Expected a permanent failure when verifying signature, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify_expiredJustNow(t *testing.T) {
+	// The signature expired one second ago, the default clock skew doesn't
+	// apply to expiration times
+	signed := strings.Replace(verifiedMailString, "c=simple/simple;", "c=simple/simple; x=424241;", 1)
+
+	verifications, err := Verify(newMailStringReader(signed))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	err = verifications[0].Err
+	if !IsPermFail(err) || !errors.Is(err, ErrSignatureExpired) {
+		t.Errorf("Expected an expired signature error, got: %v", err)
+	}
+}
+
+func TestVerify_expirationBeforeTime(t *testing.T) {
+	// The signature expires one second before it was created
+	signed := strings.Replace(verifiedMailString, "c=simple/simple;", "c=simple/simple; t=424242; x=424241;", 1)
+
+	verifications, err := Verify(newMailStringReader(signed))
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	err = verifications[0].Err
+	if !IsPermFail(err) || !errors.Is(err, ErrExpirationBeforeTime) {
+		t.Errorf("Expected an inconsistent expiration error, got: %v", err)
+	}
+}
+
+func TestVerification_MarshalJSON(t *testing.T) {
+	v := &Verification{
+		Domain:                 "example.org",
+		Identifier:             "@example.org",
+		Selector:               "brisbane",
+		Algorithm:              "rsa-sha256",
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		BodyCanonicalization:   CanonicalizationSimple,
+		HeaderKeys:             []string{"From", "To"},
+		Time:                   time.Unix(424242, 0).UTC(),
+		KeyAlgorithm:           "rsa",
+		KeySize:                2048,
+		KeyFlags:               []string{"y"},
+		Signature:              "YmFzZTY0",
+		BodyHashMatched:        true,
+		Err:                    failError(ErrSignatureMismatch, ""),
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Expected no error while marshaling verification, got: %v", err)
+	}
+
+	want := `{"domain":"example.org","identifier":"@example.org","selector":"brisbane",` +
+		`"algorithm":"rsa-sha256","header_canonicalization":"relaxed","body_canonicalization":"simple",` +
+		`"header_keys":["From","To"],"key_algorithm":"rsa","key_size":2048,"key_flags":["y"],` +
+		`"signature":"YmFzZTY0","body_hash_matched":true,"time":"1970-01-05T21:50:42Z",` +
+		`"error":"dkim: signature did not verify"}`
+	if s := string(b); s != want {
+		t.Errorf("Expected JSON to be \n%v\n but got \n%v", want, s)
+	}
+
+	// Values must be marshaled the same way as pointers
+	b, err = json.Marshal([]Verification{*v})
+	if err != nil {
+		t.Fatalf("Expected no error while marshaling verifications, got: %v", err)
+	}
+	if s := string(b); s != "["+want+"]" {
+		t.Errorf("Expected JSON to be \n[%v]\n but got \n%v", want, s)
+	}
+}
+
+func TestVerify_headerMismatch(t *testing.T) {
+	altered := strings.Replace(verifiedMailString, "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1)
+	r := newMailStringReader(altered)
+
+	verifications, err := Verify(r)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signature, got: %v", err)
+	} else if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+	}
+
+	v := verifications[0]
+	if v.Err == nil {
+		t.Error("Expected an error when verifying a message with an altered header")
+	}
+	if !v.BodyHashMatched {
+		t.Error("Expected the body hash to match")
+	}
+}
+
+func TestVerify_keyFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		selector   string
+		identifier string
+		testing    bool
+		reason     FailureReason
+	}{
+		{"testing", "testing", "", true, ""},
+		{"strict", "strict", "joe@example.org", false, ""},
+		{"strict without identifier", "strict", "", false, ""},
+		{"strict subdomain", "strict", "joe@mail.example.org", false, ErrDomainMismatch},
+		{"subdomain", "brisbane", "joe@mail.example.org", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := &SignOptions{
+				Domain:     "example.org",
+				Selector:   test.selector,
+				Identifier: test.identifier,
+				Signer:     testPrivateKey,
+			}
+
+			var b bytes.Buffer
+			if err := Sign(&b, strings.NewReader(mailString), options); err != nil {
+				t.Fatal("Expected no error while signing mail, got:", err)
+			}
+
+			verifications, err := Verify(strings.NewReader(b.String()))
+			if err != nil {
+				t.Fatalf("Expected no error while verifying signature, got: %v", err)
+			} else if len(verifications) != 1 {
+				t.Fatalf("Expected exactly one verification, got %v", len(verifications))
+			}
+
+			v := verifications[0]
+			if v.Testing != test.testing {
+				t.Errorf("Expected testing mode to be %v, got %v", test.testing, v.Testing)
+			}
+			if test.reason == "" && v.Err != nil {
+				t.Errorf("Expected no error when verifying signature, got: %v", v.Err)
+			} else if test.reason != "" && !errors.Is(v.Err, test.reason) {
+				t.Errorf("Expected reason %q, got: %v", test.reason, v.Err)
+			}
+		})
+	}
+}
+
+func signMultipleTimes(tb testing.TB, options []*SignOptions) string {
+	var b bytes.Buffer
+	if err := SignMulti(&b, strings.NewReader(mailString), options); err != nil {
+		tb.Fatal("Expected no error while signing mail, got:", err)
+	}
+	return b.String()
+}
+
+func TestVerify_multipleSignatures(t *testing.T) {
+	options := []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.com", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey, BodyLength: true},
+		{
+			Domain:                 "football.example.com",
+			Selector:               "brisbane",
+			Signer:                 testEd25519PrivateKey,
+			HeaderCanonicalization: CanonicalizationRelaxed,
+			BodyCanonicalization:   CanonicalizationRelaxed,
+		},
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey, Identifier: "joe@example.net"},
+	}
+	signed := signMultipleTimes(t, options)
+
+	verifications, err := VerifyWithOptions(strings.NewReader(signed), &VerifyOptions{AllowBodyLength: true})
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signatures, got: %v", err)
+	} else if len(verifications) != len(options) {
+		t.Fatalf("Expected %v verifications, got %v", len(options), len(verifications))
+	}
+
+	// The signatures are in reverse order
+	for i, v := range verifications[1:] {
+		if v.Err != nil {
+			t.Errorf("Expected no error when verifying signature #%v, got: %v", i+1, v.Err)
+		} else if !v.BodyHashMatched {
+			t.Errorf("Expected body hash of signature #%v to match", i+1)
+		}
+	}
+	if err := verifications[0].Err; !errors.Is(err, ErrDomainMismatch) {
+		t.Errorf("Expected domain mismatch for signature #0, got: %v", err)
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	single := signMultipleTimes(b, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+	})
+	var options []*SignOptions
+	for i := 0; i < 5; i++ {
+		options = append(options, &SignOptions{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey})
+	}
+	multiple := signMultipleTimes(b, options)
+
+	body := strings.Repeat("We lost the game. Are you hungry yet?\r\n", 64*1024/40)
+	for _, msg := range []struct {
+		name string
+		s    string
+	}{
+		{"1-signature", single},
+		{"5-signatures", multiple},
+	} {
+		// Replace the body with a larger one, the body hashes won't match
+		// but the whole body is still hashed
+		i := strings.Index(msg.s, "\r\n\r\n")
+		s := msg.s[:i+4] + body
+		b.Run(msg.name, func(b *testing.B) {
+			b.SetBytes(int64(len(s)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Verify(strings.NewReader(s)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// slowResolver blocks lookups until the body starts to be read, or until a
+// timeout expires.
+type slowResolver struct {
+	bodyRead <-chan struct{}
+	timeout  time.Duration
+}
+
+func (r *slowResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	select {
+	case <-r.bodyRead:
+		return []string{dnsPublicKey}, nil
+	case <-time.After(r.timeout):
+		return nil, &net.DNSError{Err: "timeout", Name: domain, IsTimeout: true, IsTemporary: true}
+	}
+}
+
+// bodyReader signals when the message body starts to be read.
+type bodyReader struct {
+	header, body io.Reader
+	bodyRead     chan struct{}
+	once         sync.Once
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.header.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	r.once.Do(func() { close(r.bodyRead) })
+	return r.body.Read(p)
+}
+
+func TestVerify_lookupDuringBodyHashing(t *testing.T) {
+	queryMethods["dns/txt"] = queryDNSTXT
+	defer func() { queryMethods["dns/txt"] = queryTest }()
+
+	signed := signMultipleTimes(t, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey, BodyCanonicalization: CanonicalizationRelaxed},
+	})
+	i := strings.Index(signed, "\r\n\r\n") + 4
+	r := &bodyReader{
+		header:   strings.NewReader(signed[:i]),
+		body:     strings.NewReader(signed[i:]),
+		bodyRead: make(chan struct{}),
+	}
+
+	// The lookups only complete once the body is being read, which requires
+	// them to run concurrently with body hashing
+	options := &VerifyOptions{Resolver: &slowResolver{bodyRead: r.bodyRead, timeout: 5 * time.Second}}
+	verifications, err := VerifyWithOptions(r, options)
+	if err != nil {
+		t.Fatalf("Expected no error while verifying signatures, got: %v", err)
+	} else if len(verifications) != 2 {
+		t.Fatalf("Expected 2 verifications, got %v", len(verifications))
+	}
+	for i, v := range verifications {
+		if v.Err != nil {
+			t.Errorf("Expected no error when verifying signature #%v, got: %v", i, v.Err)
+		}
+	}
+}
+
+func TestVerifier_smallWrites(t *testing.T) {
+	signed := signMultipleTimes(t, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "football.example.com", Selector: "brisbane", Signer: testEd25519PrivateKey},
+	})
+
+	v := NewVerifier(nil)
+	for i := 0; i < len(signed); i++ {
+		if _, err := v.Write([]byte{signed[i]}); err != nil {
+			t.Fatal("Expected no error while writing mail, got:", err)
+		}
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal("Expected no error while verifying mail, got:", err)
+	}
+
+	want, err := Verify(strings.NewReader(signed))
+	if err != nil {
+		t.Fatal("Expected no error while verifying mail, got:", err)
+	}
+	if verifications := v.Verifications(); !reflect.DeepEqual(verifications, want) {
+		t.Errorf("Expected verifications to be \n%+v\n but got \n%+v", want, verifications)
+	}
+	for i, verif := range v.Verifications() {
+		if verif.Err != nil {
+			t.Errorf("Expected no error when verifying signature #%v, got: %v", i, verif.Err)
+		}
+	}
+
+	if _, err := v.Write([]byte(signed)); err == nil {
+		t.Error("Expected an error when writing to a closed verifier")
+	}
+}
+
+func TestVerifier_tooManySignatures(t *testing.T) {
+	signed := signMultipleTimes(t, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+	})
+
+	v := NewVerifier(&VerifyOptions{MaxVerifications: 1})
+	if _, err := io.WriteString(v, signed); err != nil {
+		t.Fatal("Expected no error while writing mail, got:", err)
+	}
+	if err := v.Close(); err != ErrTooManySignatures {
+		t.Fatalf("Expected ErrTooManySignatures, got: %v", err)
+	}
+	if n := len(v.Verifications()); n != 1 {
+		t.Errorf("Expected 1 verification, got %v", n)
+	}
+}
+
+func TestVerifier_incompleteHeader(t *testing.T) {
+	v := NewVerifier(nil)
+	if _, err := io.WriteString(v, "From: Joe SixPack"); err != nil {
+		t.Fatal("Expected no error while writing mail, got:", err)
+	}
+	if err := v.Close(); err == nil {
+		t.Error("Expected an error when closing a verifier with an incomplete header")
+	}
+	if v.Verifications() != nil {
+		t.Error("Expected no verifications")
+	}
+}
+
+func TestVerify_limits(t *testing.T) {
+	// The signatures are in reverse order: the first one has fewer signed
+	// header fields and is shorter
+	signed := signMultipleTimes(t, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey, HeaderKeys: []string{"From", "To", "Subject", "Date"}},
+	})
+	i := strings.Index(signed, "\r\n\r\n") + 4
+
+	var p headerParser
+	p.parse([]byte(signed[:i]))
+	var sigLens []int
+	for _, kv := range p.h {
+		if k, _ := parseHeaderField(kv); strings.EqualFold(k, headerFieldName) {
+			sigLens = append(sigLens, len(kv))
+		}
+	}
+	if len(sigLens) != 2 || sigLens[0] >= sigLens[1] {
+		t.Fatalf("Unexpected signature lengths: %v", sigLens)
+	}
+
+	tests := []struct {
+		name    string
+		options VerifyOptions
+		err     bool // message-level error
+		failed  int  // index of the signature failing with ErrLimitExceeded, or -1
+	}{
+		{"none", VerifyOptions{}, false, -1},
+		{"header-bytes", VerifyOptions{MaxHeaderBytes: i - 1}, true, -1},
+		{"header-bytes-ok", VerifyOptions{MaxHeaderBytes: i}, false, -1},
+		{"header-fields", VerifyOptions{MaxHeaderFields: len(p.h) - 1}, true, -1},
+		{"header-fields-ok", VerifyOptions{MaxHeaderFields: len(p.h)}, false, -1},
+		{"signature-length", VerifyOptions{MaxSignatureLength: sigLens[0]}, false, 1},
+		{"header-keys", VerifyOptions{MaxHeaderKeys: 4}, false, 1},
+		{"dns-queries", VerifyOptions{MaxDNSQueries: 1}, false, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifications, err := VerifyWithOptions(strings.NewReader(signed), &test.options)
+			if test.err {
+				if !errors.Is(err, ErrLimitExceeded) || !IsPolicyFail(err) {
+					t.Fatalf("Expected a policy failure with reason %q, got: %v", ErrLimitExceeded, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Expected no error while verifying signatures, got: %v", err)
+			}
+
+			for i, v := range verifications {
+				if i == test.failed && (!errors.Is(v.Err, ErrLimitExceeded) || !IsPolicyFail(v.Err)) {
+					t.Errorf("Expected signature #%v to fail with reason %q, got: %v", i, ErrLimitExceeded, v.Err)
+				} else if i != test.failed && v.Err != nil {
+					t.Errorf("Expected no error when verifying signature #%v, got: %v", i, v.Err)
+				}
+			}
+		})
+	}
+}
+
+var lateCanonicalizers int
+
+func TestVerifier_canonicalizerRegisteredLate(t *testing.T) {
+	signed := signMultipleTimes(t, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+	})
+	if !strings.Contains(signed, " c=simple/simple;") {
+		t.Fatalf("Expected simple/simple canonicalization in signed message:\n%v", signed)
+	}
+	lateCanonicalizers++
+	can := Canonicalization(fmt.Sprintf("x-late%v", lateCanonicalizers))
+	signed = strings.Replace(signed, " c=simple/simple;", " c=simple/"+string(can)+";", 1)
+	i := strings.Index(signed, "\r\n\r\n") + 4
+
+	v := NewVerifier(nil)
+	if _, err := io.WriteString(v, signed[:i]); err != nil {
+		t.Fatal("Expected no error while writing header, got:", err)
+	}
+
+	// The body hash computation has been determined when the header was
+	// parsed, registering the canonicalizer now must not change it
+	RegisterCanonicalizer(can, new(noWSPCanonicalizer))
+
+	if _, err := io.WriteString(v, signed[i:]); err != nil {
+		t.Fatal("Expected no error while writing body, got:", err)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal("Expected no error while verifying mail, got:", err)
+	}
+	if verifs := v.Verifications(); len(verifs) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifs))
+	} else if err := verifs[0].Err; !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("Expected reason %q, got: %v", ErrUnsupportedAlgorithm, err)
+	}
+}
+
+func TestVerifier_cancel(t *testing.T) {
+	queryMethods["dns/txt"] = queryDNSTXT
+	defer func() { queryMethods["dns/txt"] = queryTest }()
+
+	signed := signMultipleTimes(t, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+	})
+
+	// The lookups only return once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	v := NewVerifierWithContext(ctx, &VerifyOptions{Resolver: canceledResolver{}})
+	if _, err := io.WriteString(v, signed); err != nil {
+		t.Fatal("Expected no error while writing mail, got:", err)
+	}
+	cancel()
+	if err := v.Close(); err != nil {
+		t.Fatal("Expected no error while verifying mail, got:", err)
+	}
+	if verifs := v.Verifications(); len(verifs) != 1 {
+		t.Fatalf("Expected exactly one verification, got %v", len(verifs))
+	} else if err := verifs[0].Err; !IsTempFail(err) {
+		t.Errorf("Expected a temporary failure, got: %v", err)
+	}
+}
+
+func TestVerifier_abort(t *testing.T) {
+	queryMethods["dns/txt"] = queryDNSTXT
+	defer func() { queryMethods["dns/txt"] = queryTest }()
+
+	signed := signMultipleTimes(t, []*SignOptions{
+		{Domain: "example.org", Selector: "brisbane", Signer: testPrivateKey},
+	})
+
+	// The lookups only return once the context is done, Abort must cancel it
+	headerLen := strings.Index(signed, "\r\n\r\n") + 4
+	v := NewVerifier(&VerifyOptions{Resolver: canceledResolver{}})
+	if _, err := io.WriteString(v, signed[:headerLen]); err != nil {
+		t.Fatal("Expected no error while writing mail, got:", err)
+	}
+	v.Abort()
+
+	if _, err := io.WriteString(v, signed[headerLen:]); err == nil {
+		t.Error("Expected an error while writing to an aborted verifier")
+	}
+	if err := v.Close(); err == nil {
+		t.Error("Expected an error while closing an aborted verifier")
+	}
+	if verifs := v.Verifications(); verifs != nil {
+		t.Errorf("Expected no verifications, got %v", verifs)
+	}
+}
@@ -1,6 +1,7 @@
 package dmarc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -24,10 +25,20 @@ func IsTempFail(err error) bool {
 
 var ErrNoPolicy = errors.New("dmarc: no policy found for domain")
 
+// Resolver looks up DNS TXT records. It's implemented by *net.Resolver.
+//
+// It has the same method set as dkim.Resolver, so that a single resolver can
+// be used for both DKIM and DMARC.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
 // LookupOptions allows to customize the default signature verification behavior
 // LookupTXT returns the DNS TXT records for the given domain name. If nil, net.LookupTXT is used
 type LookupOptions struct {
 	LookupTXT func(domain string) ([]string, error)
+	// Resolver looks up DNS TXT records. If set, LookupTXT is ignored.
+	Resolver Resolver
 }
 
 // Lookup queries a DMARC record for a specified domain.
@@ -36,14 +47,24 @@ func Lookup(domain string) (*Record, error) {
 }
 
 func LookupWithOptions(domain string, options *LookupOptions) (*Record, error) {
+	return LookupWithContext(context.Background(), domain, options)
+}
+
+// LookupWithContext performs the same task as LookupWithOptions, but uses ctx
+// for the DNS lookup. If ctx is canceled or times out, a temporary failure is
+// returned.
+func LookupWithContext(ctx context.Context, domain string, options *LookupOptions) (*Record, error) {
 	var txts []string
 	var err error
-	if options != nil && options.LookupTXT != nil {
+	if options != nil && options.Resolver != nil {
+		txts, err = options.Resolver.LookupTXT(ctx, "_dmarc."+domain)
+	} else if options != nil && options.LookupTXT != nil {
 		txts, err = options.LookupTXT("_dmarc." + domain)
 	} else {
-		txts, err = net.LookupTXT("_dmarc." + domain)
+		txts, err = net.DefaultResolver.LookupTXT(ctx, "_dmarc."+domain)
 	}
-	if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+	// Lookups interrupted by ctx are temporary failures
+	if netErr, ok := err.(net.Error); (ok && netErr.Temporary()) || (err != nil && ctx.Err() != nil) {
 		return nil, tempFailError("TXT record unavailable: " + err.Error())
 	} else if err != nil {
 		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {